@@ -1,27 +1,22 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+type echoMsg struct {
+	Echo string `json:"echo"`
+}
+
 func main() {
 	n := maelstrom.NewNode()
 
-	n.Handle("echo", func(msg maelstrom.Message) error {
-		// Unmarshal the message body as an loosely-typed map.
-		var body map[string]any
-		if err := json.Unmarshal(msg.Body, &body); err != nil {
-			return err
-		}
-
-		// Update the message type to return back.
-		body["type"] = "echo_ok"
-
-		// Echo the original message back with the updated message type.
-		return n.Reply(msg, body)
+	// Echo the original message back, maelstromx sets the "echo_ok" type.
+	maelstromx.Handle(n, "echo", func(msg maelstrom.Message, req echoMsg) (echoMsg, error) {
+		return req, nil
 	})
 
 	if err := n.Run(); err != nil {
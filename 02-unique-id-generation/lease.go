@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// leaseKey holds the first ID not yet leased to any node.
+const leaseKey = "ids:next"
+
+// leaseRetryInterval is how long a failed lease waits before retrying.
+const leaseRetryInterval = 10 * time.Millisecond
+
+type leaseConfig struct {
+	// blockSize is how many IDs a node leases at once.
+	blockSize int64
+	// prefetchBelow starts leasing the next block once fewer IDs remain.
+	prefetchBelow int64
+	// leaseTimeout bounds a single lease, after which IDs fall back to
+	// node-prefixed strings.
+	leaseTimeout time.Duration
+}
+
+var defaultLeaseConfig = leaseConfig{
+	blockSize:     1000,
+	prefetchBelow: 250,
+	leaseTimeout:  500 * time.Millisecond,
+}
+
+// block is a range [next, end) of leased IDs.
+type block struct {
+	next, end int64
+}
+
+func (b *block) remaining() int64 {
+	return b.end - b.next
+}
+
+// leaseGenerator hands out dense integer IDs from blocks leased with a CAS
+// on lin-kv. The next block is leased in the background before the current
+// one runs out. While lin-kv is unreachable and no leased IDs are left, it
+// returns "<node-id>-<sequence>" strings, which can't collide with the
+// integers or with other nodes.
+type leaseGenerator struct {
+	node *maelstrom.Node
+	kv   *maelstromx.KV
+	cfg  leaseConfig
+
+	mu      sync.Mutex
+	current block
+	// spares are leased blocks with IDs left, used once current runs out
+	// or for batches current can't fit.
+	spares      []block
+	prefetching bool
+	fallbackSeq int64
+
+	// unavailableUntil makes requests fall back right away for a while after
+	// a lease failed, instead of each waiting for lin-kv.
+	unavailableUntil time.Time
+}
+
+func newLeaseGenerator(n *maelstrom.Node, cfg leaseConfig) *leaseGenerator {
+	return &leaseGenerator{
+		node: n,
+		kv:   maelstromx.NewLinKV(n),
+		cfg:  cfg,
+	}
+}
+
+func (g *leaseGenerator) next() (any, error) {
+	start, _, err := g.nextRange(1)
+	if err == nil {
+		return start, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.fallbackSeq++
+	return fmt.Sprintf("%s-%d", g.node.ID(), g.fallbackSeq), nil
+}
+
+// nextRange takes count IDs from the first leased block with enough left.
+// When none has, a block of at least count IDs is leased right away, keeping
+// what remains of the others for later requests.
+func (g *leaseGenerator) nextRange(count int) (start, end int64, err error) {
+	n := int64(count)
+
+	g.mu.Lock()
+	if start, ok := g.take(n); ok {
+		g.maybePrefetch()
+		g.mu.Unlock()
+		return start, start + n, nil
+	}
+	if time.Now().Before(g.unavailableUntil) {
+		g.maybePrefetch()
+		g.mu.Unlock()
+		return 0, 0, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "lin-kv is unavailable")
+	}
+	g.mu.Unlock()
+
+	b, err := g.lease(max(n, g.cfg.blockSize))
+	if err != nil {
+		g.mu.Lock()
+		g.unavailableUntil = time.Now().Add(g.cfg.leaseTimeout)
+		g.mu.Unlock()
+
+		return 0, 0, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, fmt.Sprintf("lease ids: %v", err))
+	}
+
+	start = b.next
+	b.next += n
+
+	g.mu.Lock()
+	g.keep(b)
+	g.mu.Unlock()
+
+	return start, start + n, nil
+}
+
+// take hands out n IDs from current or else the first spare block with
+// enough left. g.mu must be held.
+func (g *leaseGenerator) take(n int64) (int64, bool) {
+	for g.current.remaining() == 0 && len(g.spares) > 0 {
+		g.current, g.spares = g.spares[0], g.spares[1:]
+	}
+
+	if g.current.remaining() >= n {
+		start := g.current.next
+		g.current.next += n
+		return start, true
+	}
+	for i := range g.spares {
+		if b := &g.spares[i]; b.remaining() >= n {
+			start := b.next
+			b.next += n
+			if b.remaining() == 0 {
+				g.spares = slices.Delete(g.spares, i, i+1)
+			}
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+// remaining returns how many leased IDs are left. g.mu must be held.
+func (g *leaseGenerator) remaining() int64 {
+	n := g.current.remaining()
+	for _, b := range g.spares {
+		n += b.remaining()
+	}
+	return n
+}
+
+// maybePrefetch leases the next block in the background when the leased
+// IDs run low. g.mu must be held.
+func (g *leaseGenerator) maybePrefetch() {
+	if g.prefetching || g.remaining() >= g.cfg.prefetchBelow {
+		return
+	}
+
+	g.prefetching = true
+	go func() {
+		b, err := g.lease(g.cfg.blockSize)
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		g.prefetching = false
+		if err != nil {
+			log.Printf("prefetch ids: %v", err)
+			return
+		}
+		g.keep(b)
+	}()
+}
+
+// keep stores the IDs left in a leased block for later requests. g.mu must
+// be held.
+func (g *leaseGenerator) keep(b block) {
+	switch {
+	case b.remaining() == 0:
+	case g.current.remaining() == 0:
+		g.current = b
+	default:
+		g.spares = append(g.spares, b)
+	}
+}
+
+// lease reserves size IDs by advancing leaseKey with a CAS, retrying until it
+// succeeds or the lease times out.
+func (g *leaseGenerator) lease(size int64) (block, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.leaseTimeout)
+	defer cancel()
+
+	for {
+		next, err := g.kv.ReadInt(ctx, leaseKey)
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			next, err = 0, nil
+		}
+
+		if err == nil {
+			err = g.kv.CompareAndSwap(ctx, leaseKey, next, next+int(size), true)
+			if err == nil {
+				return block{next: int64(next), end: int64(next) + size}, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return block{}, err
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+}
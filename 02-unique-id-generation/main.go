@@ -1,25 +1,151 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
 
-	"github.com/google/uuid"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+// ID strategies, selected with the ID_STRATEGY environment variable.
+const (
+	// strategyUUID generates random UUID strings.
+	strategyUUID = "uuid"
+	// strategySnowflake generates time-ordered 64-bit integers.
+	strategySnowflake = "snowflake"
+	// strategyULID generates time-ordered 26 character strings.
+	strategyULID = "ulid"
+	// strategyLease generates dense integers from blocks leased from lin-kv.
+	strategyLease = "lease"
+)
+
+type config struct {
+	strategy string
+	lease    leaseConfig
+}
+
+var defaultConfig = config{
+	strategy: strategyUUID,
+	lease:    defaultLeaseConfig,
+}
+
 func main() {
 	n := maelstrom.NewNode()
 
-	n.Handle("generate", func(msg maelstrom.Message) error {
-		var body = map[string]any{
-			"type": "generate_ok",
-			"id":   uuid.New().String(),
-		}
+	cfg := defaultConfig
+	if strategy := os.Getenv("ID_STRATEGY"); strategy != "" {
+		cfg.strategy = strategy
+	}
 
-		return n.Reply(msg, body)
-	})
+	if _, err := newServer(n, cfg); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// maxBatchCount limits how many IDs a single generate_batch returns.
+const maxBatchCount = 4096
+
+// generator returns IDs unique across all nodes.
+type generator interface {
+	next() (any, error)
+}
+
+// rangeGenerator is implemented by generators of integer IDs that can hand
+// out a contiguous range [start, end) at once.
+type rangeGenerator interface {
+	nextRange(count int) (start, end int64, err error)
+}
+
+// newServer creates a server using the configured ID strategy and registers
+// its handlers on the node.
+func newServer(n *maelstrom.Node, cfg config) (*server, error) {
+	s := &server{
+		node: n,
+	}
+
+	switch cfg.strategy {
+	case strategyUUID:
+		s.generator = uuidGenerator{}
+	case strategySnowflake:
+		s.generator = newSnowflake(n)
+	case strategyULID:
+		s.generator = newULIDGenerator()
+	case strategyLease:
+		s.generator = newLeaseGenerator(n, cfg.lease)
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q", cfg.strategy)
+	}
+
+	maelstromx.Handle(n, "generate", s.handleGenerate)
+	maelstromx.Handle(n, "generate_batch", s.handleGenerateBatch)
+
+	return s, nil
+}
+
+type server struct {
+	node      *maelstrom.Node
+	generator generator
+}
+
+type generateResponse struct {
+	ID any `json:"id"`
+}
+
+type generateBatchRequest struct {
+	Count int `json:"count"`
+}
+
+func (r generateBatchRequest) Validate() error {
+	if r.Count < 1 || r.Count > maxBatchCount {
+		return fmt.Errorf("count must be between 1 and %d", maxBatchCount)
+	}
+	return nil
+}
+
+// generateBatchResponse holds either the generated IDs or, for range
+// generators, the range [start, end) of IDs.
+type generateBatchResponse struct {
+	IDs   []any  `json:"ids,omitempty"`
+	Start *int64 `json:"start,omitempty"`
+	End   *int64 `json:"end,omitempty"`
+}
+
+func (s *server) handleGenerate(msg maelstrom.Message, req struct{}) (generateResponse, error) {
+	id, err := s.generator.next()
+	if err != nil {
+		return generateResponse{}, err
+	}
+
+	return generateResponse{ID: id}, nil
+}
+
+func (s *server) handleGenerateBatch(msg maelstrom.Message, req generateBatchRequest) (generateBatchResponse, error) {
+	if g, ok := s.generator.(rangeGenerator); ok {
+		start, end, err := g.nextRange(req.Count)
+		if err == nil {
+			return generateBatchResponse{Start: &start, End: &end}, nil
+		}
+
+		// Without a range, the generator may still have fallback IDs.
+		if maelstrom.ErrorCode(err) != maelstrom.TemporarilyUnavailable {
+			return generateBatchResponse{}, err
+		}
+	}
+
+	ids := make([]any, 0, req.Count)
+	for range req.Count {
+		id, err := s.generator.next()
+		if err != nil {
+			return generateBatchResponse{}, err
+		}
+		ids = append(ids, id)
+	}
+
+	return generateBatchResponse{IDs: ids}, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, strategy := range []string{strategyUUID, strategySnowflake, strategyULID, strategyLease} {
+		t.Run(strategy, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			net.AddKV(maelstrom.LinKV)
+			net.AddNodes(3, func(n *maelstrom.Node) {
+				if _, err := newServer(n, withStrategy(strategy)); err != nil {
+					t.Fatal(err)
+				}
+			})
+			net.Start()
+
+			// Partitions must not matter, as IDs are generated locally.
+			net.PartitionHalves()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var mu sync.Mutex
+			seen := map[string]string{}
+
+			var wg sync.WaitGroup
+			for _, id := range net.NodeIDs() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					c := net.Client()
+					for range 100 {
+						var resp struct {
+							ID json.RawMessage `json:"id"`
+						}
+						if err := c.RPCInto(ctx, id, map[string]any{"type": "generate"}, &resp); err != nil {
+							t.Errorf("generate on %s: %v", id, err)
+							return
+						}
+
+						mu.Lock()
+						if other, ok := seen[string(resp.ID)]; ok {
+							t.Errorf("id %s generated by both %s and %s", resp.ID, other, id)
+						}
+						seen[string(resp.ID)] = id
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestGenerateBatch(t *testing.T) {
+	for _, strategy := range []string{strategyUUID, strategySnowflake, strategyULID, strategyLease} {
+		t.Run(strategy, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			net.AddKV(maelstrom.LinKV)
+			net.AddNodes(3, func(n *maelstrom.Node) { newServer(n, withStrategy(strategy)) })
+			net.Start()
+
+			net.PartitionHalves()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var mu sync.Mutex
+			seen := map[string]string{}
+
+			var wg sync.WaitGroup
+			for _, id := range net.NodeIDs() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					c := net.Client()
+					for range 10 {
+						// generate and generate_batch draw from the same IDs.
+						var one struct {
+							ID json.RawMessage `json:"id"`
+						}
+						if err := c.RPCInto(ctx, id, map[string]any{"type": "generate"}, &one); err != nil {
+							t.Errorf("generate on %s: %v", id, err)
+							return
+						}
+
+						ids, err := generateBatch(ctx, c, id, 1000)
+						if err != nil {
+							t.Errorf("generate_batch on %s: %v", id, err)
+							return
+						}
+						if len(ids) != 1000 {
+							t.Errorf("generate_batch on %s returned %d ids, want 1000", id, len(ids))
+						}
+
+						mu.Lock()
+						for _, generated := range append(ids, string(one.ID)) {
+							if other, ok := seen[generated]; ok {
+								t.Errorf("id %s generated by both %s and %s", generated, other, id)
+							}
+							seen[generated] = id
+						}
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestGenerateBatch_invalidCount(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(n *maelstrom.Node) { newServer(n, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, count := range []int{0, maxBatchCount + 1} {
+		_, err := net.Client().RPC(ctx, "n0", map[string]any{"type": "generate_batch", "count": count})
+		if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+			t.Errorf("count %d: got error %v, want MalformedRequest", count, err)
+		}
+	}
+}
+
+// generateBatch requests count IDs from node and returns them as JSON,
+// expanding ranges.
+func generateBatch(ctx context.Context, c *maelstromtest.Client, node string, count int) ([]string, error) {
+	var resp struct {
+		IDs   []json.RawMessage `json:"ids"`
+		Start *int64            `json:"start"`
+		End   *int64            `json:"end"`
+	}
+	if err := c.RPCInto(ctx, node, map[string]any{"type": "generate_batch", "count": count}, &resp); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, count)
+	for _, id := range resp.IDs {
+		ids = append(ids, string(id))
+	}
+	if resp.Start != nil && resp.End != nil {
+		for id := *resp.Start; id < *resp.End; id++ {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+	}
+
+	return ids, nil
+}
+
+func TestGenerate_snowflakeOrdered(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(n *maelstrom.Node) { newServer(n, withStrategy(strategySnowflake)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	last := int64(-1)
+	for i := range 20 {
+		id := net.NodeIDs()[i%2]
+
+		var resp struct {
+			ID int64 `json:"id"`
+		}
+		if err := c.RPCInto(ctx, id, map[string]any{"type": "generate"}, &resp); err != nil {
+			t.Fatalf("generate on %s: %v", id, err)
+		}
+
+		// Requests are 5ms apart, more than the ordering guarantee needs.
+		if resp.ID <= last {
+			t.Fatalf("id %d from %s after %d", resp.ID, id, last)
+		}
+		last = resp.ID
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGenerate_leaseDense(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+
+	cfg := withStrategy(strategyLease)
+	cfg.lease.blockSize = 10
+	cfg.lease.prefetchBelow = 3
+	net.AddNodes(3, func(n *maelstrom.Node) { newServer(n, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := map[int64]bool{}
+
+	var wg sync.WaitGroup
+	for _, id := range net.NodeIDs() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			for range 100 {
+				var resp struct {
+					ID int64 `json:"id"`
+				}
+				if err := c.RPCInto(ctx, id, map[string]any{"type": "generate"}, &resp); err != nil {
+					t.Errorf("generate on %s: %v", id, err)
+					return
+				}
+
+				mu.Lock()
+				if seen[resp.ID] {
+					t.Errorf("id %d generated twice", resp.ID)
+				}
+				seen[resp.ID] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// At most the current and the prefetched block of every node are left
+	// unused.
+	for id := range seen {
+		if limit := int64(300 + 3*2*10); id >= limit {
+			t.Errorf("id %d is not dense, want below %d", id, limit)
+		}
+	}
+}
+
+func TestGenerate_leaseBatchFromSpare(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+
+	cfg := withStrategy(strategyLease)
+	cfg.lease.blockSize = 10
+	cfg.lease.prefetchBelow = 5
+	net.AddNodes(1, func(n *maelstrom.Node) { newServer(n, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	var got []string
+	generate := func(count int) {
+		t.Helper()
+
+		if count == 1 {
+			var resp struct {
+				ID json.RawMessage `json:"id"`
+			}
+			if err := c.RPCInto(ctx, "n0", map[string]any{"type": "generate"}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(resp.ID))
+			return
+		}
+
+		ids, err := generateBatch(ctx, c, "n0", count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ids...)
+	}
+
+	// Taking 6 IDs of the first block prefetches the second one, which the
+	// batch doesn't fit into what's left of the first.
+	for range 6 {
+		generate(1)
+	}
+	time.Sleep(100 * time.Millisecond)
+	generate(5)
+	for range 9 {
+		generate(1)
+	}
+
+	want := strings.Fields("0 1 2 3 4 5 10 11 12 13 14 6 7 8 9 15 16 17 18 19")
+	if !slices.Equal(got, want) {
+		t.Errorf("got ids %v, want %v", got, want)
+	}
+}
+
+func TestGenerate_leaseFallback(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	kv := &unreachableKV{KV: maelstromtest.NewKV(maelstrom.LinKV, rand.New(rand.NewSource(1)))}
+	kv.down.Store(true)
+	net.AddService(maelstrom.LinKV, kv)
+
+	cfg := withStrategy(strategyLease)
+	cfg.lease.leaseTimeout = 100 * time.Millisecond
+	net.AddNodes(2, func(n *maelstrom.Node) { newServer(n, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	seen := map[string]bool{}
+	for _, id := range net.NodeIDs() {
+		ids, err := generateBatch(ctx, c, id, 500)
+		if err != nil {
+			t.Fatalf("generate_batch on %s: %v", id, err)
+		}
+
+		for _, generated := range ids {
+			if !strings.HasPrefix(generated, `"`+id+`-`) {
+				t.Fatalf("got id %s from %s while lin-kv is down, want a %s- prefix", generated, id, id)
+			}
+			if seen[generated] {
+				t.Fatalf("id %s generated twice", generated)
+			}
+			seen[generated] = true
+		}
+	}
+
+	kv.down.Store(false)
+
+	maelstromtest.Eventually(t, 2*time.Second, func() error {
+		var resp struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := c.RPCInto(ctx, "n0", map[string]any{"type": "generate"}, &resp); err != nil {
+			return err
+		}
+		if _, err := strconv.ParseInt(string(resp.ID), 10, 64); err != nil {
+			return fmt.Errorf("got id %s after lin-kv recovered, want an integer", resp.ID)
+		}
+		return nil
+	})
+}
+
+func TestGenerate_leaseLateReplies(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddService(maelstrom.LinKV, &slowKV{KV: maelstromtest.NewKV(maelstrom.LinKV, rand.New(rand.NewSource(1))), delay: 300 * time.Millisecond})
+
+	cfg := withStrategy(strategyLease)
+	cfg.lease.leaseTimeout = 100 * time.Millisecond
+	setup := func(n *maelstrom.Node) { newServer(n, cfg) }
+	net.AddNodes(1, setup)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var resp struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := net.Client().RPCInto(ctx, "n0", map[string]any{"type": "generate"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp.ID), `"n0-`) {
+		t.Errorf("got id %s while lin-kv is slow, want a n0- prefix", resp.ID)
+	}
+
+	// lin-kv replies once the lease gave up. Restart waits for the old node
+	// to stop, so it hangs if a reply's callback blocks.
+	time.Sleep(400 * time.Millisecond)
+	net.Restart("n0", setup)
+}
+
+// unreachableKV drops every request while down is set.
+type unreachableKV struct {
+	*maelstromtest.KV
+	down atomic.Bool
+}
+
+func (kv *unreachableKV) Handle(msg maelstrom.Message) any {
+	if kv.down.Load() {
+		return nil
+	}
+	return kv.KV.Handle(msg)
+}
+
+// slowKV answers every request after delay.
+type slowKV struct {
+	*maelstromtest.KV
+	delay time.Duration
+}
+
+func (kv *slowKV) Handle(msg maelstrom.Message) any {
+	time.Sleep(kv.delay)
+	return kv.KV.Handle(msg)
+}
+
+func withStrategy(strategy string) config {
+	cfg := defaultConfig
+	cfg.strategy = strategy
+	return cfg
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// uuidGenerator returns random version 4 UUIDs. Collisions are negligible, so
+// nodes need no coordination at all.
+type uuidGenerator struct{}
+
+func (uuidGenerator) next() (any, error) {
+	return uuid.New().String(), nil
+}
+
+// ulidGenerator returns ULIDs: a millisecond timestamp followed by 80 random
+// bits. IDs from one node increase monotonically, even within a millisecond,
+// and IDs from different nodes sort by time.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	entropy *ulid.MonotonicEntropy
+}
+
+func newULIDGenerator() *ulidGenerator {
+	return &ulidGenerator{
+		entropy: ulid.Monotonic(rand.Reader, 0),
+	}
+}
+
+func (g *ulidGenerator) next() (any, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id, err := ulid.New(ulid.Timestamp(time.Now()), g.entropy)
+	if err != nil {
+		return nil, err
+	}
+	return id.String(), nil
+}
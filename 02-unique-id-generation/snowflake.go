@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Snowflake IDs are 63-bit integers, leaving the sign bit clear, laid out
+// from the most significant bit as a millisecond timestamp, the node index
+// and a per-node sequence.
+const (
+	timestampBits = 41
+	nodeBits      = 10
+	sequenceBits  = 12
+
+	maxNodeIndex = 1<<nodeBits - 1
+	maxSequence  = 1<<sequenceBits - 1
+)
+
+// snowflakeEpoch is the zero timestamp. 41 bits of milliseconds last about 69
+// years from it.
+var snowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflake generates k-sortable IDs: IDs generated more than a few
+// milliseconds apart sort by time on any node, and IDs from one node always
+// increase.
+//
+// The generator never waits. When the sequence of a millisecond is exhausted
+// or the clock moves backwards, it keeps counting from the last timestamp it
+// used, running ahead of the clock until the clock catches up.
+type snowflake struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	nodeIndex int64
+	timestamp int64
+	sequence  int64
+}
+
+func newSnowflake(n *maelstrom.Node) *snowflake {
+	s := &snowflake{
+		now:       time.Now,
+		nodeIndex: -1,
+	}
+
+	n.Handle("init", func(msg maelstrom.Message) error {
+		index, err := nodeIndex(n.ID(), n.NodeIDs())
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.nodeIndex = index
+		s.mu.Unlock()
+		return nil
+	})
+
+	return s
+}
+
+// nodeIndex derives the node bits from a Maelstrom node ID such as "n3".
+// IDs not in that form use their position in nodeIDs.
+func nodeIndex(id string, nodeIDs []string) (int64, error) {
+	index, err := strconv.ParseInt(strings.TrimPrefix(id, "n"), 10, 64)
+	if err != nil || !strings.HasPrefix(id, "n") {
+		index = int64(slices.Index(nodeIDs, id))
+	}
+
+	if index < 0 || index > maxNodeIndex {
+		return 0, fmt.Errorf("node %s has no snowflake index between 0 and %d", id, maxNodeIndex)
+	}
+	return index, nil
+}
+
+func (s *snowflake) next() (any, error) {
+	start, _, err := s.nextRange(1)
+	return start, err
+}
+
+// nextRange reserves count consecutive sequence numbers of one millisecond,
+// which make up the contiguous IDs [start, end).
+func (s *snowflake) nextRange(count int) (start, end int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodeIndex < 0 {
+		return 0, 0, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node is not initialized")
+	}
+	if count < 1 || count > maxSequence+1 {
+		return 0, 0, maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("count must be between 1 and %d", maxSequence+1))
+	}
+
+	first := s.sequence + 1
+	if timestamp := s.now().Sub(snowflakeEpoch).Milliseconds(); timestamp > s.timestamp {
+		s.timestamp = timestamp
+		first = 0
+	}
+	if first+int64(count)-1 > maxSequence {
+		s.timestamp++
+		first = 0
+	}
+	s.sequence = first + int64(count) - 1
+
+	if s.timestamp >= 1<<timestampBits {
+		return 0, 0, maelstrom.NewRPCError(maelstrom.Crash, "snowflake timestamp overflow")
+	}
+
+	start = s.timestamp<<(nodeBits+sequenceBits) | s.nodeIndex<<sequenceBits | first
+	return start, start + int64(count), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock returns the times set by the test.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestSnowflake(clock *fakeClock, index int64) *snowflake {
+	return &snowflake{now: clock.now, nodeIndex: index}
+}
+
+func nextInt(t *testing.T, s *snowflake) int64 {
+	t.Helper()
+
+	id, err := s.next()
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	return id.(int64)
+}
+
+func TestSnowflake_layout(t *testing.T) {
+	clock := &fakeClock{t: snowflakeEpoch.Add(1234 * time.Millisecond)}
+	s := newTestSnowflake(clock, 5)
+
+	nextInt(t, s)
+	id := nextInt(t, s)
+
+	if got := id >> (nodeBits + sequenceBits); got != 1234 {
+		t.Errorf("timestamp = %d, want 1234", got)
+	}
+	if got := id >> sequenceBits & maxNodeIndex; got != 5 {
+		t.Errorf("node index = %d, want 5", got)
+	}
+	if got := id & maxSequence; got != 1 {
+		t.Errorf("sequence = %d, want 1", got)
+	}
+}
+
+func TestSnowflake_increasing(t *testing.T) {
+	tests := []struct {
+		name string
+		tick func(c *fakeClock)
+	}{
+		{name: "same millisecond", tick: func(c *fakeClock) {}},
+		{name: "clock moving forward", tick: func(c *fakeClock) { c.t = c.t.Add(time.Millisecond) }},
+		{name: "clock moving backwards", tick: func(c *fakeClock) { c.t = c.t.Add(-time.Second) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: snowflakeEpoch.Add(time.Hour)}
+			s := newTestSnowflake(clock, 1)
+
+			// Enough IDs to exhaust the sequence of a millisecond twice.
+			last := int64(-1)
+			for range 3 * (maxSequence + 1) {
+				id := nextInt(t, s)
+				if id <= last {
+					t.Fatalf("id %d after %d", id, last)
+				}
+				last = id
+				tt.tick(clock)
+			}
+		})
+	}
+}
+
+func TestSnowflake_catchesUpWithClock(t *testing.T) {
+	clock := &fakeClock{t: snowflakeEpoch.Add(time.Hour)}
+	s := newTestSnowflake(clock, 1)
+
+	before := nextInt(t, s)
+	clock.t = clock.t.Add(-time.Second)
+	nextInt(t, s)
+	clock.t = clock.t.Add(2 * time.Second)
+
+	id := nextInt(t, s)
+	if got, want := id>>(nodeBits+sequenceBits), before>>(nodeBits+sequenceBits)+1000; got != want {
+		t.Errorf("timestamp = %d, want %d", got, want)
+	}
+}
+
+func TestSnowflake_uninitialized(t *testing.T) {
+	s := newTestSnowflake(&fakeClock{t: snowflakeEpoch}, -1)
+
+	if _, err := s.next(); err == nil {
+		t.Error("next succeeded before the node index was known")
+	}
+}
+
+func TestNodeIndex(t *testing.T) {
+	tests := []struct {
+		id      string
+		nodeIDs []string
+		want    int64
+		wantErr bool
+	}{
+		{id: "n0", nodeIDs: []string{"n0"}, want: 0},
+		{id: "n17", nodeIDs: []string{"n0", "n17"}, want: 17},
+		{id: "b", nodeIDs: []string{"a", "b"}, want: 1},
+		{id: "n1024", nodeIDs: []string{"n1024"}, wantErr: true},
+		{id: "c", nodeIDs: []string{"a", "b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := nodeIndex(tt.id, tt.nodeIDs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodeIndex error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("nodeIndex = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnowflake_nextRange(t *testing.T) {
+	clock := &fakeClock{t: snowflakeEpoch.Add(time.Hour)}
+	s := newTestSnowflake(clock, 1)
+
+	last := nextInt(t, s)
+	for _, count := range []int{1, 100, maxSequence + 1, 4000, 200} {
+		start, end, err := s.nextRange(count)
+		if err != nil {
+			t.Fatalf("nextRange(%d): %v", count, err)
+		}
+		if end-start != int64(count) {
+			t.Errorf("nextRange(%d) = [%d, %d), want %d ids", count, start, end, count)
+		}
+		if start>>sequenceBits != (end-1)>>sequenceBits {
+			t.Errorf("nextRange(%d) = [%d, %d) spans milliseconds", count, start, end)
+		}
+		if start <= last {
+			t.Errorf("nextRange(%d) starts at %d after %d", count, start, last)
+		}
+		last = end - 1
+	}
+
+	if _, _, err := s.nextRange(maxSequence + 2); err == nil {
+		t.Error("nextRange succeeded for more ids than a millisecond has")
+	}
+}
@@ -1,27 +1,34 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 func main() {
 	n := maelstrom.NewNode()
+	newServer(n)
 
-	s := server{
+	if err := n.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServer creates a server and registers its handlers on the node.
+func newServer(n *maelstrom.Node) *server {
+	s := &server{
 		node: n,
 	}
 
-	n.Handle("broadcast", s.handleBroadcast)
-	n.Handle("read", s.handleRead)
-	n.Handle("topology", s.handleTopology)
+	maelstromx.Handle(n, "broadcast", s.handleBroadcast)
+	maelstromx.Handle(n, "read", s.handleRead)
+	maelstromx.Handle(n, "topology", s.handleTopology)
 
-	if err := n.Run(); err != nil {
-		log.Fatal(err)
-	}
+	return s
 }
 
 type server struct {
@@ -31,42 +38,36 @@ type server struct {
 	values   []float64
 }
 
-func (s *server) handleBroadcast(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
-
-	s.valuesMu.Lock()
-	s.values = append(s.values, body["message"].(float64))
-	s.valuesMu.Unlock()
+type broadcastRequest struct {
+	Message *float64 `json:"message"`
+}
 
-	response := map[string]any{
-		"type": "broadcast_ok",
+func (r broadcastRequest) Validate() error {
+	if r.Message == nil {
+		return errors.New("missing message")
 	}
+	return nil
+}
 
-	return s.node.Reply(msg, response)
+type readResponse struct {
+	Messages []float64 `json:"messages"`
 }
-func (s *server) handleRead(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
 
+func (s *server) handleBroadcast(msg maelstrom.Message, req broadcastRequest) (struct{}, error) {
 	s.valuesMu.Lock()
-	response := map[string]any{
-		"type":     "read_ok",
-		"messages": s.values,
-	}
+	s.values = append(s.values, *req.Message)
 	s.valuesMu.Unlock()
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
 
-func (s *server) handleTopology(msg maelstrom.Message) error {
-	response := map[string]any{
-		"type": "topology_ok",
-	}
+func (s *server) handleRead(msg maelstrom.Message, req struct{}) (readResponse, error) {
+	s.valuesMu.Lock()
+	defer s.valuesMu.Unlock()
+
+	return readResponse{Messages: append([]float64{}, s.values...)}, nil
+}
 
-	return s.node.Reply(msg, response)
+func (s *server) handleTopology(msg maelstrom.Message, req struct{}) (struct{}, error) {
+	return struct{}{}, nil
 }
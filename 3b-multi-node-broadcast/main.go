@@ -1,29 +1,36 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 	n := maelstrom.NewNode()
+	newServer(n)
 
-	s := server{
+	if err := n.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServer creates a server and registers its handlers on the node.
+func newServer(n *maelstrom.Node) *server {
+	s := &server{
 		node: n,
 	}
 
-	n.Handle("broadcast", s.handleBroadcast)
-	n.Handle("read", s.handleRead)
-	n.Handle("topology", s.handleTopology)
-	n.Handle("broadcast_ok", func(msg maelstrom.Message) error { return nil })
+	maelstromx.Handle(n, "broadcast", s.handleBroadcast)
+	maelstromx.Handle(n, "read", s.handleRead)
+	maelstromx.Handle(n, "topology", s.handleTopology)
+	maelstromx.HandleNoReply(n, "broadcast_ok", func(msg maelstrom.Message, req struct{}) error { return nil })
 
-	if err := n.Run(); err != nil {
-		log.Fatal(err)
-	}
+	return s
 }
 
 type server struct {
@@ -35,28 +42,36 @@ type server struct {
 	values   []float64
 }
 
-func (s *server) handleBroadcast(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+type broadcastRequest struct {
+	Message *float64 `json:"message"`
+}
+
+func (r broadcastRequest) Validate() error {
+	if r.Message == nil {
+		return errors.New("missing message")
 	}
+	return nil
+}
+
+type readResponse struct {
+	Messages []float64 `json:"messages"`
+}
 
-	message := body["message"].(float64)
+type topologyRequest struct {
+	Topology map[string][]string `json:"topology"`
+}
 
+func (s *server) handleBroadcast(msg maelstrom.Message, req broadcastRequest) (struct{}, error) {
 	s.valuesMu.Lock()
-	s.values = append(s.values, message)
+	s.values = append(s.values, *req.Message)
 	s.valuesMu.Unlock()
 
-	err := s.broadcastToNeighbors(message, msg.Src)
+	err := s.broadcastToNeighbors(*req.Message, msg.Src)
 	if err != nil {
-		return err
-	}
-
-	response := map[string]any{
-		"type": "broadcast_ok",
+		return struct{}{}, err
 	}
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
 
 func (s *server) broadcastToNeighbors(id float64, src string) error {
@@ -80,36 +95,15 @@ func (s *server) broadcastToNeighbors(id float64, src string) error {
 	return errGroup.Wait()
 }
 
-func (s *server) handleRead(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
-
+func (s *server) handleRead(msg maelstrom.Message, req struct{}) (readResponse, error) {
 	s.valuesMu.Lock()
-	response := map[string]any{
-		"type":     "read_ok",
-		"messages": s.values,
-	}
-	s.valuesMu.Unlock()
+	defer s.valuesMu.Unlock()
 
-	return s.node.Reply(msg, response)
+	return readResponse{Messages: append([]float64{}, s.values...)}, nil
 }
 
-func (s *server) handleTopology(msg maelstrom.Message) error {
-	var body struct {
-		Topology map[string][]string `json:"topology"`
-	}
-
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
-
-	s.topology = body.Topology
-
-	response := map[string]any{
-		"type": "topology_ok",
-	}
+func (s *server) handleTopology(msg maelstrom.Message, req topologyRequest) (struct{}, error) {
+	s.topology = req.Topology
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
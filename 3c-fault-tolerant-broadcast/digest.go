@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// digest summarizes a set of values as sorted, non-overlapping ranges of
+// consecutive integers, and other values as ranges of one. Broadcast messages are mostly dense, so a digest of
+// thousands of values usually collapses into a handful of ranges.
+type digest [][2]float64
+
+func newDigest(values []float64) digest {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	d := digest{}
+	for _, value := range sorted {
+		if last := len(d) - 1; last >= 0 {
+			end := d[last][1]
+			if value == end {
+				continue
+			}
+			if value == end+1 && isInteger(end) {
+				d[last][1] = value
+				continue
+			}
+		}
+		// Values that aren't integers get a range of their own.
+		d = append(d, [2]float64{value, value})
+	}
+
+	return d
+}
+
+func (d digest) contains(value float64) bool {
+	i := sort.Search(len(d), func(i int) bool { return d[i][1] >= value })
+	if i == len(d) || d[i][0] > value {
+		return false
+	}
+	return value == d[i][0] || isInteger(value)
+}
+
+func isInteger(value float64) bool {
+	return value == math.Trunc(value)
+}
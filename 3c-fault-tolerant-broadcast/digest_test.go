@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewDigest(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   digest
+	}{
+		{
+			name:   "empty",
+			values: nil,
+			want:   digest{},
+		},
+		{
+			name:   "single range",
+			values: []float64{3, 1, 2, 4},
+			want:   digest{{1, 4}},
+		},
+		{
+			name:   "gaps",
+			values: []float64{10, 1, 2, 7, 5, 6},
+			want:   digest{{1, 2}, {5, 7}, {10, 10}},
+		},
+		{
+			name:   "duplicates",
+			values: []float64{2, 1, 2, 3, 1},
+			want:   digest{{1, 3}},
+		},
+		{
+			name:   "fractions",
+			values: []float64{1, 1.5, 2, 3, 3.5, 4.5},
+			want:   digest{{1, 1}, {1.5, 1.5}, {2, 3}, {3.5, 3.5}, {4.5, 4.5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newDigest(tt.values)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newDigest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigest_contains(t *testing.T) {
+	d := newDigest([]float64{1, 2, 3, 7, 8, 12})
+
+	for _, value := range []float64{1, 2, 3, 7, 8, 12} {
+		if !d.contains(value) {
+			t.Errorf("contains(%v) = false, want true", value)
+		}
+	}
+
+	for _, value := range []float64{0, 4, 6, 9, 11, 13} {
+		if d.contains(value) {
+			t.Errorf("contains(%v) = true, want false", value)
+		}
+	}
+}
+
+func TestDigest_containsFractions(t *testing.T) {
+	d := newDigest([]float64{1, 1.5, 2, 3, 5.5, 6.5, 7.5})
+
+	for _, value := range []float64{1, 1.5, 2, 3, 5.5, 6.5, 7.5} {
+		if !d.contains(value) {
+			t.Errorf("contains(%v) = false, want true", value)
+		}
+	}
+
+	for _, value := range []float64{1.2, 2.5, 4, 5, 6, 7, 8.5} {
+		if d.contains(value) {
+			t.Errorf("contains(%v) = true, want false", value)
+		}
+	}
+}
@@ -3,125 +3,253 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+// antiEntropyInterval is how often a node reconciles its values with a random
+// peer.
+const antiEntropyInterval = 500 * time.Millisecond
+
 func main() {
 	n := maelstrom.NewNode()
+	s := newServer(n)
 
-	s := server{
-		node:   n,
-		values: map[float64]interface{}{},
+	err := n.Run()
+	s.close()
+	if err != nil {
+		log.Fatal(err)
 	}
+}
 
-	n.Handle("broadcast", s.handleBroadcast)
-	n.Handle("read", s.handleRead)
-	n.Handle("topology", s.handleTopology)
-
-	if err := n.Run(); err != nil {
-		log.Fatal(err)
+// newServer creates a server and registers its handlers on the node.
+func newServer(n *maelstrom.Node) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &server{
+		node:     n,
+		ctx:      ctx,
+		cancel:   cancel,
+		values:   map[float64]interface{}{},
+		outboxes: map[string]*outbox{},
 	}
+
+	n.Handle("init", s.handleInit)
+	maelstromx.Handle(n, "broadcast", s.handleBroadcast)
+	maelstromx.Handle(n, "read", s.handleRead)
+	maelstromx.Handle(n, "topology", s.handleTopology)
+	maelstromx.Handle(n, "forward", s.handleForward)
+	maelstromx.Handle(n, "sync", s.handleSync)
+
+	return s
 }
 
 type server struct {
 	node *maelstrom.Node
 
-	topology map[string][]string
+	// ctx is cancelled by close and stops the outboxes and anti-entropy.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	topologyMu sync.Mutex
+	topology   map[string][]string
 
 	valuesMu sync.Mutex
 	values   map[float64]interface{}
+
+	// outboxes holds the outbound queue for each peer, created in handleInit.
+	outboxes map[string]*outbox
 }
 
-func (s *server) handleBroadcast(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+type broadcastRequest struct {
+	Message *float64 `json:"message"`
+}
+
+func (r broadcastRequest) Validate() error {
+	if r.Message == nil {
+		return errors.New("missing message")
 	}
+	return nil
+}
+
+type forwardRequest struct {
+	Messages []float64 `json:"messages"`
+}
+
+type syncRequest struct {
+	Digest digest `json:"digest"`
+}
 
-	message := body["message"].(float64)
+type syncResponse struct {
+	Missing []float64 `json:"missing"`
+}
+
+type readResponse struct {
+	Messages []float64 `json:"messages"`
+}
+
+type topologyRequest struct {
+	Topology map[string][]string `json:"topology"`
+}
+
+func (s *server) handleBroadcast(msg maelstrom.Message, req broadcastRequest) (struct{}, error) {
+	s.storeAndForward([]float64{*req.Message}, msg.Src)
+
+	return struct{}{}, nil
+}
+
+func (s *server) handleForward(msg maelstrom.Message, req forwardRequest) (struct{}, error) {
+	s.storeAndForward(req.Messages, msg.Src)
+
+	return struct{}{}, nil
+}
+
+// storeAndForward saves new messages and queues them for every neighbor
+// except src.
+func (s *server) storeAndForward(messages []float64, src string) {
+	fresh := make([]float64, 0, len(messages))
 
 	s.valuesMu.Lock()
-	if _, exists := s.values[message]; exists {
-		return s.node.Reply(msg, map[string]any{
-			"type": "broadcast_ok",
-		})
+	for _, message := range messages {
+		if _, exists := s.values[message]; exists {
+			continue
+		}
+		s.values[message] = struct{}{}
+		fresh = append(fresh, message)
 	}
-	s.values[message] = struct{}{}
 	s.valuesMu.Unlock()
 
-	// Broadcast to neighbors
-	for _, nodeId := range s.topology[s.node.ID()] {
-		if nodeId == msg.Src {
+	if len(fresh) == 0 {
+		return
+	}
+
+	s.topologyMu.Lock()
+	neighbors := s.topology[s.node.ID()]
+	s.topologyMu.Unlock()
+
+	for _, nodeId := range neighbors {
+		if nodeId == src {
 			continue
 		}
 
-		s.broadcast(nodeId, message)
+		if o, ok := s.outboxes[nodeId]; ok {
+			o.push(fresh...)
+		}
 	}
+}
 
-	return s.node.Reply(msg, map[string]any{
-		"type": "broadcast_ok",
-	})
+// close stops the background work of the server once the node stopped.
+func (s *server) close() {
+	s.cancel()
 }
 
-func (s *server) broadcast(dest string, message float64) {
-	body := map[string]any{
-		"type":    "broadcast",
-		"message": message,
+func (s *server) handleInit(msg maelstrom.Message) error {
+	for _, nodeID := range s.node.NodeIDs() {
+		if nodeID == s.node.ID() {
+			continue
+		}
+
+		o := newOutbox(s.node, nodeID, defaultQueueConfig)
+		s.outboxes[nodeID] = o
+		go o.run(s.ctx)
 	}
 
-	var i time.Duration
-	for i = 1; ; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
-		defer cancel()
+	go s.antiEntropyLoop()
+	return nil
+}
+
+func (s *server) antiEntropyLoop() {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
 
-		_, err := s.node.SyncRPC(ctx, dest, body)
-		if err == nil {
-			break
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		peers := make([]string, 0, len(s.node.NodeIDs()))
+		for _, nodeID := range s.node.NodeIDs() {
+			if nodeID != s.node.ID() {
+				peers = append(peers, nodeID)
+			}
+		}
+		if len(peers) == 0 {
+			continue
+		}
+
+		if err := s.syncWith(peers[rand.Intn(len(peers))]); err != nil {
+			log.Printf("anti-entropy failed: %v", err)
+		}
 	}
 }
 
-func (s *server) handleRead(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
+// syncWith sends a digest of local values to the peer and stores the
+// messages the peer has that are missing locally.
+func (s *server) syncWith(peer string) error {
+	ctx, cancel := context.WithTimeout(s.ctx, antiEntropyInterval)
+	defer cancel()
+
+	resp, err := maelstromx.SyncRPC(ctx, s.node, peer, map[string]any{
+		"type":   "sync",
+		"digest": newDigest(s.snapshot()),
+	})
+	if err != nil {
+		return err
+	}
+
+	var body syncResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
 		return err
 	}
 
 	s.valuesMu.Lock()
-	valuesSlice := make([]float64, 0, len(s.values))
-	for value := range s.values {
-		valuesSlice = append(valuesSlice, value)
+	for _, value := range body.Missing {
+		s.values[value] = struct{}{}
 	}
 	s.valuesMu.Unlock()
 
-	response := map[string]any{
-		"type":     "read_ok",
-		"messages": valuesSlice,
+	return nil
+}
+
+// handleSync replies with the local values not covered by the sender's digest.
+func (s *server) handleSync(msg maelstrom.Message, req syncRequest) (syncResponse, error) {
+	missing := []float64{}
+	for _, value := range s.snapshot() {
+		if !req.Digest.contains(value) {
+			missing = append(missing, value)
+		}
 	}
 
-	return s.node.Reply(msg, response)
+	return syncResponse{Missing: missing}, nil
 }
 
-func (s *server) handleTopology(msg maelstrom.Message) error {
-	var body struct {
-		Topology map[string][]string `json:"topology"`
-	}
+func (s *server) snapshot() []float64 {
+	s.valuesMu.Lock()
+	defer s.valuesMu.Unlock()
 
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+	valuesSlice := make([]float64, 0, len(s.values))
+	for value := range s.values {
+		valuesSlice = append(valuesSlice, value)
 	}
 
-	s.topology = body.Topology
+	return valuesSlice
+}
 
-	response := map[string]any{
-		"type": "topology_ok",
-	}
+func (s *server) handleRead(msg maelstrom.Message, req struct{}) (readResponse, error) {
+	return readResponse{Messages: s.snapshot()}, nil
+}
+
+func (s *server) handleTopology(msg maelstrom.Message, req topologyRequest) (struct{}, error) {
+	s.topologyMu.Lock()
+	s.topology = req.Topology
+	s.topologyMu.Unlock()
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/broadcasttest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestBroadcast(t *testing.T) {
+	broadcasttest.Broadcast(t, startNetwork(t))
+}
+
+func TestBroadcast_partition(t *testing.T) {
+	broadcasttest.Partition(t, startNetwork(t))
+}
+
+// startNetwork starts five nodes connected in a line topology, so messages
+// have to be forwarded through other nodes.
+func startNetwork(t *testing.T) *maelstromtest.Network {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(5, func(node *maelstrom.Node) { t.Cleanup(newServer(node).close) })
+	net.Start()
+
+	nodeIDs := net.NodeIDs()
+	topology := map[string][]string{}
+	for i, id := range nodeIDs {
+		if i > 0 {
+			topology[id] = append(topology[id], nodeIDs[i-1])
+		}
+		if i < len(nodeIDs)-1 {
+			topology[id] = append(topology[id], nodeIDs[i+1])
+		}
+	}
+	broadcasttest.SetTopology(t, net, topology)
+
+	return net
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type queueConfig struct {
+	// maxInFlight limits concurrent forward RPCs to a single neighbor.
+	maxInFlight int
+	// maxBatch limits how many queued messages are coalesced into one RPC.
+	maxBatch int
+	// maxQueued limits messages waiting for a neighbor. Messages over the
+	// limit are dropped and left to anti-entropy.
+	maxQueued int
+
+	rpcTimeout  time.Duration
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+var defaultQueueConfig = queueConfig{
+	maxInFlight: 4,
+	maxBatch:    100,
+	maxQueued:   10_000,
+	rpcTimeout:  1000 * time.Millisecond,
+	baseBackoff: 50 * time.Millisecond,
+	maxBackoff:  2000 * time.Millisecond,
+}
+
+// outbox forwards messages to a single neighbor. Messages queued while
+// earlier RPCs are in flight are coalesced into one batch, and failed batches
+// are requeued and retried with exponential backoff.
+type outbox struct {
+	node *maelstrom.Node
+	dest string
+	cfg  queueConfig
+
+	mu       sync.Mutex
+	queued   map[float64]struct{}
+	failures int
+
+	notify chan struct{}
+}
+
+func newOutbox(node *maelstrom.Node, dest string, cfg queueConfig) *outbox {
+	return &outbox{
+		node:   node,
+		dest:   dest,
+		cfg:    cfg,
+		queued: map[float64]struct{}{},
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) push(messages ...float64) {
+	o.mu.Lock()
+	for _, message := range messages {
+		if len(o.queued) >= o.cfg.maxQueued {
+			break
+		}
+		o.queued[message] = struct{}{}
+	}
+	o.mu.Unlock()
+
+	o.wake()
+}
+
+func (o *outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run sends queued batches until ctx is cancelled.
+func (o *outbox) run(ctx context.Context) {
+	inFlight := make(chan struct{}, o.cfg.maxInFlight)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.notify:
+		}
+
+		for {
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			// Back off before sending, so batches requeued by failed sends
+			// are retried only after the delay.
+			if err := sleep(ctx, o.backoff()); err != nil {
+				return
+			}
+
+			batch := o.take()
+			if len(batch) == 0 {
+				<-inFlight
+				break
+			}
+
+			go func() {
+				defer func() { <-inFlight }()
+				o.send(ctx, batch)
+			}()
+		}
+	}
+}
+
+func (o *outbox) take() []float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	batch := make([]float64, 0, min(len(o.queued), o.cfg.maxBatch))
+	for message := range o.queued {
+		if len(batch) == o.cfg.maxBatch {
+			break
+		}
+		batch = append(batch, message)
+		delete(o.queued, message)
+	}
+
+	return batch
+}
+
+func (o *outbox) send(ctx context.Context, batch []float64) {
+	ctx, cancel := context.WithTimeout(ctx, o.cfg.rpcTimeout)
+	defer cancel()
+
+	_, err := maelstromx.SyncRPC(ctx, o.node, o.dest, map[string]any{
+		"type":     "forward",
+		"messages": batch,
+	})
+
+	o.mu.Lock()
+	if err == nil {
+		o.failures = 0
+		o.mu.Unlock()
+		return
+	}
+	o.failures++
+	o.mu.Unlock()
+
+	log.Printf("forward to %s failed: %v", o.dest, err)
+	o.push(batch...)
+}
+
+// backoff returns the delay before the next batch, growing exponentially
+// with consecutive failures and randomized to avoid synchronized retries.
+func (o *outbox) backoff() time.Duration {
+	o.mu.Lock()
+	failures := o.failures
+	o.mu.Unlock()
+
+	if failures == 0 {
+		return 0
+	}
+
+	d := o.cfg.maxBackoff
+	if shift := failures - 1; shift < 16 {
+		d = min(o.cfg.baseBackoff<<shift, o.cfg.maxBackoff)
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestOutbox_take(t *testing.T) {
+	cfg := defaultQueueConfig
+	cfg.maxBatch = 3
+	cfg.maxQueued = 5
+
+	o := newOutbox(nil, "n1", cfg)
+	o.push(1, 2, 3, 4, 5, 6, 7)
+
+	if got := len(o.queued); got != 5 {
+		t.Fatalf("queued %d messages, want 5", got)
+	}
+
+	if got := len(o.take()); got != 3 {
+		t.Errorf("first batch has %d messages, want 3", got)
+	}
+	if got := len(o.take()); got != 2 {
+		t.Errorf("second batch has %d messages, want 2", got)
+	}
+	if got := len(o.take()); got != 0 {
+		t.Errorf("third batch has %d messages, want 0", got)
+	}
+}
+
+func TestOutbox_backoff(t *testing.T) {
+	cfg := defaultQueueConfig
+	cfg.baseBackoff = 100 * time.Millisecond
+	cfg.maxBackoff = 400 * time.Millisecond
+
+	o := newOutbox(nil, "n1", cfg)
+
+	tests := []struct {
+		failures int
+		min, max time.Duration
+	}{
+		{failures: 0, min: 0, max: 0},
+		{failures: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{failures: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{failures: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{failures: 50, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		o.failures = tt.failures
+		for range 100 {
+			if got := o.backoff(); got < tt.min || got > tt.max {
+				t.Fatalf("backoff() after %d failures = %v, want in [%v, %v]", tt.failures, got, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestOutbox_backsOffBeforeRetry(t *testing.T) {
+	cfg := defaultQueueConfig
+	cfg.baseBackoff = 200 * time.Millisecond
+
+	// n1 fails the first forward, so n0 has to retry it.
+	var mu sync.Mutex
+	var received []time.Time
+	var o *outbox
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) {
+		if o == nil {
+			o = newOutbox(node, "n1", cfg)
+		}
+		maelstromx.Handle(node, "forward", func(msg maelstrom.Message, req forwardRequest) (struct{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			received = append(received, time.Now())
+			if len(received) == 1 {
+				return struct{}{}, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "not yet")
+			}
+			return struct{}{}, nil
+		})
+	})
+	net.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.run(ctx)
+	o.push(1)
+
+	maelstromtest.Eventually(t, 2*time.Second, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(received) < 2 {
+			return errors.New("forward wasn't retried")
+		}
+		return nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gap := received[1].Sub(received[0]); gap < cfg.baseBackoff/2 {
+		t.Errorf("retried after %v, want at least %v", gap, cfg.baseBackoff/2)
+	}
+}
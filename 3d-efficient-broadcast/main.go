@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// flushInterval is how often pending messages are sent to neighbors.
+	flushInterval = 100 * time.Millisecond
+
+	// gossipTimeout bounds a single gossip RPC, after which the batch is resent.
+	gossipTimeout = 1000 * time.Millisecond
+)
+
+func main() {
+	n := maelstrom.NewNode()
+	newServer(n)
+
+	if err := n.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServer creates a server and registers its handlers on the node.
+func newServer(n *maelstrom.Node) *server {
+	s := &server{
+		node:     n,
+		values:   map[float64]struct{}{},
+		pending:  map[string]map[float64]struct{}{},
+		inFlight: map[string]bool{},
+	}
+
+	n.Handle("init", s.handleInit)
+	maelstromx.Handle(n, "broadcast", s.handleBroadcast)
+	maelstromx.Handle(n, "gossip", s.handleGossip)
+	maelstromx.Handle(n, "read", s.handleRead)
+	maelstromx.Handle(n, "topology", s.handleTopology)
+
+	return s
+}
+
+type server struct {
+	node *maelstrom.Node
+
+	neighbors []string
+
+	valuesMu sync.Mutex
+	values   map[float64]struct{}
+
+	// pending holds messages not yet acknowledged by each neighbor.
+	pendingMu sync.Mutex
+	pending   map[string]map[float64]struct{}
+	inFlight  map[string]bool
+}
+
+type broadcastRequest struct {
+	Message *float64 `json:"message"`
+}
+
+func (r broadcastRequest) Validate() error {
+	if r.Message == nil {
+		return errors.New("missing message")
+	}
+	return nil
+}
+
+type gossipRequest struct {
+	Messages []float64 `json:"messages"`
+}
+
+type readResponse struct {
+	Messages []float64 `json:"messages"`
+}
+
+func (s *server) handleInit(msg maelstrom.Message) error {
+	s.neighbors = hubTopology(s.node.ID(), s.node.NodeIDs())
+
+	for _, neighbor := range s.neighbors {
+		s.pending[neighbor] = map[float64]struct{}{}
+	}
+
+	go s.flushLoop()
+
+	return nil
+}
+
+// hubTopology connects the first node to every other node and every other
+// node only to the first one, so any message reaches all nodes in two hops.
+func hubTopology(id string, nodeIDs []string) []string {
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+
+	hub := nodeIDs[0]
+	if id != hub {
+		return []string{hub}
+	}
+
+	neighbors := make([]string, 0, len(nodeIDs)-1)
+	for _, nodeID := range nodeIDs {
+		if nodeID != hub {
+			neighbors = append(neighbors, nodeID)
+		}
+	}
+
+	return neighbors
+}
+
+func (s *server) handleBroadcast(msg maelstrom.Message, req broadcastRequest) (struct{}, error) {
+	s.store([]float64{*req.Message}, msg.Src)
+
+	return struct{}{}, nil
+}
+
+func (s *server) handleGossip(msg maelstrom.Message, req gossipRequest) (struct{}, error) {
+	s.store(req.Messages, msg.Src)
+
+	return struct{}{}, nil
+}
+
+// store saves new messages and queues them for every neighbor except src.
+func (s *server) store(messages []float64, src string) {
+	fresh := make([]float64, 0, len(messages))
+
+	s.valuesMu.Lock()
+	for _, message := range messages {
+		if _, exists := s.values[message]; exists {
+			continue
+		}
+		s.values[message] = struct{}{}
+		fresh = append(fresh, message)
+	}
+	s.valuesMu.Unlock()
+
+	if len(fresh) == 0 {
+		return
+	}
+
+	s.pendingMu.Lock()
+	for _, neighbor := range s.neighbors {
+		if neighbor == src {
+			continue
+		}
+		for _, message := range fresh {
+			s.pending[neighbor][message] = struct{}{}
+		}
+	}
+	s.pendingMu.Unlock()
+}
+
+func (s *server) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.flush()
+	}
+}
+
+// flush sends one batch to every neighbor that has pending messages and no
+// batch in flight.
+func (s *server) flush() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	for _, neighbor := range s.neighbors {
+		if s.inFlight[neighbor] || len(s.pending[neighbor]) == 0 {
+			continue
+		}
+
+		batch := make([]float64, 0, len(s.pending[neighbor]))
+		for message := range s.pending[neighbor] {
+			batch = append(batch, message)
+		}
+
+		s.inFlight[neighbor] = true
+		go s.gossip(neighbor, batch)
+	}
+}
+
+func (s *server) gossip(dest string, batch []float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), gossipTimeout)
+	defer cancel()
+
+	_, err := maelstromx.SyncRPC(ctx, s.node, dest, map[string]any{
+		"type":     "gossip",
+		"messages": batch,
+	})
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	s.inFlight[dest] = false
+	if err != nil {
+		return
+	}
+
+	for _, message := range batch {
+		delete(s.pending[dest], message)
+	}
+}
+
+func (s *server) handleRead(msg maelstrom.Message, req struct{}) (readResponse, error) {
+	s.valuesMu.Lock()
+	valuesSlice := make([]float64, 0, len(s.values))
+	for value := range s.values {
+		valuesSlice = append(valuesSlice, value)
+	}
+	s.valuesMu.Unlock()
+
+	return readResponse{Messages: valuesSlice}, nil
+}
+
+// handleTopology acknowledges the topology suggested by Maelstrom but keeps
+// the hub topology computed in handleInit.
+func (s *server) handleTopology(msg maelstrom.Message, req struct{}) (struct{}, error) {
+	return struct{}{}, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/broadcasttest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestBroadcast(t *testing.T) {
+	broadcasttest.Broadcast(t, startNetwork(t))
+}
+
+func TestBroadcast_partition(t *testing.T) {
+	broadcasttest.Partition(t, startNetwork(t))
+}
+
+// startNetwork starts five nodes. Maelstrom's topology is ignored in favor of
+// the hub topology, so an empty one is sent.
+func startNetwork(t *testing.T) *maelstromtest.Network {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(5, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	broadcasttest.SetTopology(t, net, map[string][]string{})
+
+	return net
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// casCounter serializes every add to a counter through a CAS on a single
+// SeqKV key named after the counter.
+type casCounter struct {
+	kv    *maelstromx.KV
+	index *counterIndex
+}
+
+func newCASCounter(node *maelstrom.Node) *casCounter {
+	kv := maelstromx.NewSeqKV(node)
+
+	return &casCounter{
+		kv:    kv,
+		index: newCounterIndex(kv),
+	}
+}
+
+// add retries the CAS until it succeeds or ctx is done.
+func (c *casCounter) add(ctx context.Context, name string, delta int) error {
+	if err := c.index.register(ctx, name); err != nil {
+		return err
+	}
+
+	for {
+		counterVal, err := c.kv.ReadInt(ctx, name)
+		if err != nil && maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			counterVal, err = 0, nil
+		}
+
+		if err == nil {
+			err = c.kv.CompareAndSwap(ctx, name, counterVal, counterVal+delta, true)
+			if err == nil {
+				return nil
+			}
+		}
+
+		if err := sleep(ctx, retryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// read retries until the counter is read stably or ctx is done.
+func (c *casCounter) read(ctx context.Context, name string) (int, error) {
+	for {
+		counterVal, err := c.readWithSynchronization(ctx, name)
+		if err == nil {
+			return counterVal, nil
+		}
+
+		if err := sleep(ctx, retryInterval); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reads the counter and confirms its value is stable
+func (c *casCounter) readWithSynchronization(ctx context.Context, name string) (int, error) {
+	counterVal, err := c.kv.ReadInt(ctx, name)
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return 0, nil
+		} else {
+			return 0, err
+		}
+	}
+
+	// Use a no-op CAS to ensure consistency
+	err = c.kv.CompareAndSwap(ctx, name, counterVal, counterVal, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return counterVal, nil
+}
+
+func (c *casCounter) list(ctx context.Context) ([]string, error) {
+	return c.index.list(ctx)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// gossipInterval is how often a node sends its counter state to peers.
+const gossipInterval = 200 * time.Millisecond
+
+// tally maps a node id to the total that node added. Every node only
+// increments its own entry, so tallies are merged by taking the maximum of
+// each entry.
+type tally map[string]int
+
+func (t tally) merge(other tally) {
+	for nodeID, count := range other {
+		t[nodeID] = max(t[nodeID], count)
+	}
+}
+
+func (t tally) sum() int {
+	sum := 0
+	for _, count := range t {
+		sum += count
+	}
+	return sum
+}
+
+// pnState is the state of a single counter. As a G-Counter it only has the
+// positive tally. As a PN-Counter negative deltas go to a separate negative
+// tally and the value is P−N, keeping both tallies grow-only.
+type pnState struct {
+	Positive tally `json:"p"`
+	Negative tally `json:"n"`
+}
+
+func newPNState() *pnState {
+	return &pnState{Positive: tally{}, Negative: tally{}}
+}
+
+func (st *pnState) clone() *pnState {
+	return &pnState{Positive: maps.Clone(st.Positive), Negative: maps.Clone(st.Negative)}
+}
+
+// crdtCounter keeps a state-based counter CRDT for every counter name. Adds
+// are local and always available, and peers converge once they exchange
+// states.
+type crdtCounter struct {
+	node *maelstrom.Node
+
+	// decrements allows negative deltas.
+	decrements bool
+
+	mu       sync.Mutex
+	counters map[string]*pnState
+}
+
+type counterStateMsg struct {
+	Counters map[string]*pnState `json:"counters"`
+}
+
+// newGCounter returns a grow-only counter that rejects negative deltas.
+func newGCounter(node *maelstrom.Node) *crdtCounter {
+	return newCRDTCounter(node, false)
+}
+
+// newPNCounter returns a counter accepting both positive and negative deltas.
+func newPNCounter(node *maelstrom.Node) *crdtCounter {
+	return newCRDTCounter(node, true)
+}
+
+func newCRDTCounter(node *maelstrom.Node, decrements bool) *crdtCounter {
+	c := &crdtCounter{
+		node:       node,
+		decrements: decrements,
+		counters:   map[string]*pnState{},
+	}
+
+	node.Handle("init", func(msg maelstrom.Message) error {
+		go c.gossipLoop()
+		return nil
+	})
+	maelstromx.HandleNoReply(node, "counter_state", c.handleState)
+
+	return c
+}
+
+func (c *crdtCounter) add(ctx context.Context, name string, delta int) error {
+	if delta < 0 && !c.decrements {
+		return maelstromx.Errorf(maelstrom.MalformedRequest, "grow-only counter cannot add %d", delta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.state(name)
+	if delta < 0 {
+		st.Negative[c.node.ID()] -= delta
+	} else {
+		st.Positive[c.node.ID()] += delta
+	}
+	return nil
+}
+
+func (c *crdtCounter) read(ctx context.Context, name string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.counters[name]
+	if !ok {
+		return 0, nil
+	}
+	return st.Positive.sum() - st.Negative.sum(), nil
+}
+
+// list returns the sorted names of the counters known to this node.
+func (c *crdtCounter) list(ctx context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(c.counters)), nil
+}
+
+// state returns the state of the named counter, creating it if needed.
+// c.mu must be held.
+func (c *crdtCounter) state(name string) *pnState {
+	st, ok := c.counters[name]
+	if !ok {
+		st = newPNState()
+		c.counters[name] = st
+	}
+	return st
+}
+
+func (c *crdtCounter) handleState(msg maelstrom.Message, req counterStateMsg) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, other := range req.Counters {
+		st := c.state(name)
+		st.Positive.merge(other.Positive)
+		st.Negative.merge(other.Negative)
+	}
+	return nil
+}
+
+// gossipLoop periodically sends the full state to every peer. Lost messages
+// need no retries, as later states supersede them.
+func (c *crdtCounter) gossipLoop() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		counters := make(map[string]*pnState, len(c.counters))
+		for name, st := range c.counters {
+			counters[name] = st.clone()
+		}
+		c.mu.Unlock()
+
+		for _, nodeID := range c.node.NodeIDs() {
+			if nodeID == c.node.ID() {
+				continue
+			}
+
+			body := map[string]any{"type": "counter_state", "counters": counters}
+			if err := c.node.Send(nodeID, body); err != nil {
+				log.Printf("gossip to %s failed: %v", nodeID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// indexKey holds the names of all counters stored in the KV. Counter names
+// can't contain ':', so it never clashes with a counter's own keys.
+const indexKey = ":counters"
+
+// counterIndex records counter names in the KV for list_counters.
+type counterIndex struct {
+	kv *maelstromx.KV
+
+	// known caches names already in the index, so only the first add to a
+	// counter on each node touches it.
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+func newCounterIndex(kv *maelstromx.KV) *counterIndex {
+	return &counterIndex{
+		kv:    kv,
+		known: map[string]bool{},
+	}
+}
+
+// register adds name to the index unless it is already there, retrying the
+// CAS until it succeeds or ctx is done.
+func (idx *counterIndex) register(ctx context.Context, name string) error {
+	idx.mu.Lock()
+	known := idx.known[name]
+	idx.mu.Unlock()
+
+	if known {
+		return nil
+	}
+
+	for {
+		names, err := idx.read(ctx)
+		if err == nil {
+			if slices.Contains(names, name) {
+				break
+			}
+
+			err = idx.kv.CompareAndSwap(ctx, indexKey, names, append(names, name), true)
+			if err == nil {
+				break
+			}
+		}
+
+		if err := sleep(ctx, retryInterval); err != nil {
+			return err
+		}
+	}
+
+	idx.mu.Lock()
+	idx.known[name] = true
+	idx.mu.Unlock()
+
+	return nil
+}
+
+// list returns the sorted counter names.
+func (idx *counterIndex) list(ctx context.Context) ([]string, error) {
+	names, err := idx.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(names)
+	return names, nil
+}
+
+func (idx *counterIndex) read(ctx context.Context) ([]string, error) {
+	var names []string
+	if err := idx.kv.ReadInto(ctx, indexKey, &names); err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	return names, nil
+}
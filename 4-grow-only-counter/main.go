@@ -2,108 +2,217 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
-const counterName = "counter"
+// Counter modes, selected with the COUNTER_MODE environment variable.
+const (
+	// modeCAS keeps a single counter in SeqKV updated with CAS.
+	modeCAS = "cas"
+	// modeCRDT keeps a G-Counter on every node and gossips it to peers.
+	modeCRDT = "crdt"
+	// modePN keeps a PN-Counter on every node, allowing negative deltas.
+	modePN = "pn"
+	// modeSharded keeps one SeqKV key per node and sums them on read.
+	modeSharded = "sharded"
+)
+
+// retryInterval is how long a failed KV operation waits before retrying.
+const retryInterval = 100 * time.Millisecond
+
+type config struct {
+	mode string
+	// requestTimeout bounds the handling of a single add or read.
+	requestTimeout time.Duration
+	// staleOK makes reads that fail answer with the last value the node
+	// read instead of an error.
+	staleOK bool
+}
+
+var defaultConfig = config{
+	mode:           modeCAS,
+	requestTimeout: 1000 * time.Millisecond,
+}
 
 func main() {
 	node := maelstrom.NewNode()
-	kv := maelstrom.NewSeqKV(node)
 
-	s := server{
-		node: node,
-		kv:   kv,
+	cfg := defaultConfig
+	if mode := os.Getenv("COUNTER_MODE"); mode != "" {
+		cfg.mode = mode
 	}
+	cfg.staleOK = os.Getenv("COUNTER_STALE_OK") == "true"
 
-	node.Handle("add", s.handleAdd)
-	node.Handle("read", s.handleRead)
+	if _, err := newServer(node, cfg); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := node.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-type server struct {
-	node *maelstrom.Node
-	kv   *maelstrom.KV
+// defaultCounter is the counter used by requests without a key.
+const defaultCounter = "counter"
+
+// counter stores the named counters behind the add, read and list_counters
+// handlers.
+type counter interface {
+	add(ctx context.Context, name string, delta int) error
+	read(ctx context.Context, name string) (int, error)
+	list(ctx context.Context) ([]string, error)
 }
 
-func (s *server) handleAdd(msg maelstrom.Message) error {
-	var body map[string]any
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+// newServer creates a server using the configured counter mode and registers
+// its handlers on the node.
+func newServer(node *maelstrom.Node, cfg config) (*server, error) {
+	s := &server{
+		node:     node,
+		cfg:      cfg,
+		lastRead: map[string]int{},
 	}
 
-	delta := int(body["delta"].(float64))
+	switch cfg.mode {
+	case modeCAS:
+		s.counter = newCASCounter(node)
+	case modeCRDT:
+		s.counter = newGCounter(node)
+	case modePN:
+		s.counter = newPNCounter(node)
+	case modeSharded:
+		s.counter = newShardedCounter(node)
+	default:
+		return nil, fmt.Errorf("unknown counter mode %q", cfg.mode)
+	}
 
-	for {
-		counterVal, err := s.kv.ReadInt(context.TODO(), counterName)
-		if err != nil {
-			if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-				counterVal = 0
-			} else {
-				return err
-			}
-		}
+	maelstromx.Handle(node, "add", s.handleAdd)
+	maelstromx.Handle(node, "read", s.handleRead)
+	maelstromx.Handle(node, "list_counters", s.handleListCounters)
 
-		err = s.kv.CompareAndSwap(context.TODO(), counterName, counterVal, counterVal+delta, true)
-		if err == nil {
-			break
-		}
+	return s, nil
+}
 
-		time.Sleep(100 * time.Millisecond)
-	}
+type server struct {
+	node    *maelstrom.Node
+	cfg     config
+	counter counter
+
+	// lastRead holds the value of the latest successful read of each
+	// counter, served to failed reads in stale-ok mode.
+	lastReadMu sync.Mutex
+	lastRead   map[string]int
+}
 
-	response := map[string]any{
-		"type": "add_ok",
-	}
+type addRequest struct {
+	Key   string `json:"key"`
+	Delta int    `json:"delta"`
+}
 
-	return s.node.Reply(msg, response)
+func (r addRequest) Validate() error {
+	return validateKey(r.Key)
 }
 
-func (s *server) handleRead(msg maelstrom.Message) error {
-	var counterVal int
-	var err error
+type readRequest struct {
+	Key string `json:"key"`
+}
 
-	for {
-		counterVal, err = s.readCounterWithSynchronization()
-		if err != nil {
-			time.Sleep(100 * time.Second)
-			continue
-		}
+func (r readRequest) Validate() error {
+	return validateKey(r.Key)
+}
 
-		break
+type readResponse struct {
+	Value int `json:"value"`
+}
+
+type listCountersResponse struct {
+	Counters []string `json:"counters"`
+}
+
+// validateKey rejects ':' in counter names, which the KV modes use to build
+// their own keys.
+func validateKey(key string) error {
+	if strings.Contains(key, ":") {
+		return fmt.Errorf("key %q must not contain ':'", key)
 	}
+	return nil
+}
+
+// counterName returns the counter addressed by key.
+func counterName(key string) string {
+	if key == "" {
+		return defaultCounter
+	}
+	return key
+}
+
+func (s *server) handleAdd(msg maelstrom.Message, req addRequest) (struct{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.requestTimeout)
+	defer cancel()
+
+	if err := s.counter.add(ctx, counterName(req.Key), req.Delta); err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.MalformedRequest {
+			return struct{}{}, err
+		}
 
-	response := map[string]any{
-		"type":  "read_ok",
-		"value": counterVal,
+		// The delta may have been stored before the failure, so the outcome
+		// is indefinite.
+		return struct{}{}, maelstromx.Errorf(maelstrom.Timeout, "add: %v", err)
 	}
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
 
-// reads the counter and confirms its value is stable
-func (s *server) readCounterWithSynchronization() (int, error) {
-	counterVal, err := s.kv.ReadInt(context.TODO(), counterName)
+func (s *server) handleRead(msg maelstrom.Message, req readRequest) (readResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.requestTimeout)
+	defer cancel()
+
+	name := counterName(req.Key)
+	value, err := s.counter.read(ctx, name)
+
+	s.lastReadMu.Lock()
+	defer s.lastReadMu.Unlock()
+
 	if err != nil {
-		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-			return 0, nil
-		} else {
-			return 0, err
+		if s.cfg.staleOK {
+			return readResponse{Value: s.lastRead[name]}, nil
 		}
+
+		// Reads have no effects, so failing them is always safe.
+		return readResponse{}, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "read: %v", err)
 	}
 
-	// Use a no-op CAS to ensure consistency
-	err = s.kv.CompareAndSwap(context.TODO(), counterName, counterVal, counterVal, false)
+	s.lastRead[name] = value
+	return readResponse{Value: value}, nil
+}
+
+func (s *server) handleListCounters(msg maelstrom.Message, req struct{}) (listCountersResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.requestTimeout)
+	defer cancel()
+
+	names, err := s.counter.list(ctx)
 	if err != nil {
-		return 0, err
+		return listCountersResponse{}, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "list counters: %v", err)
 	}
 
-	return counterVal, nil
+	return listCountersResponse{Counters: names}, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestCounter(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	kv := net.AddKV(maelstrom.SeqKV)
+	net.AddNodes(3, func(node *maelstrom.Node) { newServer(node, withMode(modeCAS)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Stale reads make the CAS in add fail and retry.
+	kv.SetStaleRate(0.3)
+
+	var h checker.History
+	addConcurrently(ctx, net, &h, 0, 1, 2, 3, 4)
+
+	kv.SetStaleRate(0)
+
+	readAllAndCheck(ctx, t, net, &h)
+}
+
+func TestCounter_sharded(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	kv := net.AddKV(maelstrom.SeqKV)
+	net.AddNodes(3, func(node *maelstrom.Node) { newServer(node, withMode(modeSharded)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var h checker.History
+	addConcurrently(ctx, net, &h, 0, 1, 2, 3, 4)
+
+	// The barrier write must keep reads fresh even when every read could be
+	// stale.
+	kv.SetStaleRate(1)
+
+	readAllAndCheck(ctx, t, net, &h)
+}
+
+func TestCounter_crdt(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, func(node *maelstrom.Node) { newServer(node, withMode(modeCRDT)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Adds are local, so they succeed even on isolated nodes.
+	net.Isolate("n0")
+
+	var h checker.History
+	addConcurrently(ctx, net, &h, 0, 1, 2, 3, 4)
+
+	net.Heal()
+
+	waitForValue(ctx, t, net, 30)
+
+	readAllAndCheck(ctx, t, net, &h)
+}
+
+func TestCounter_pn(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(5, func(node *maelstrom.Node) { newServer(node, withMode(modePN)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var h checker.History
+
+	// Both sides of each partition keep accepting adds, and the tallies of
+	// every round must merge once the network heals.
+	net.PartitionHalves()
+	addConcurrently(ctx, net, &h, 5, -2, 3)
+	net.Heal()
+	waitForValue(ctx, t, net, 30)
+
+	net.Isolate("n2")
+	addConcurrently(ctx, net, &h, -4, -4, 1)
+	net.Heal()
+	waitForValue(ctx, t, net, -5)
+
+	readAllAndCheck(ctx, t, net, &h)
+}
+
+func TestCounter_crdtRejectsNegativeDelta(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, withMode(modeCRDT)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := net.Client().RPC(ctx, "n0", map[string]any{"type": "add", "delta": -1})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Fatalf("add -1: got error %v (code %d), want MalformedRequest", err, code)
+	}
+}
+
+func TestCounter_deadlines(t *testing.T) {
+	for _, mode := range []string{modeCAS, modeSharded} {
+		t.Run(mode, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			kv := &unreachableKV{KV: maelstromtest.NewKV(maelstrom.SeqKV, rand.New(rand.NewSource(1)))}
+			net.AddService(maelstrom.SeqKV, kv)
+
+			cfg := withMode(mode)
+			cfg.requestTimeout = 200 * time.Millisecond
+			net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, cfg) })
+			net.Start()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c := net.Client()
+			kv.down.Store(true)
+
+			_, err := c.RPC(ctx, "n0", map[string]any{"type": "add", "delta": 1})
+			if code := maelstrom.ErrorCode(err); code != maelstrom.Timeout {
+				t.Errorf("add: got error %v, want Timeout", err)
+			}
+
+			_, err = c.RPC(ctx, "n0", map[string]any{"type": "read"})
+			if code := maelstrom.ErrorCode(err); code != maelstrom.TemporarilyUnavailable {
+				t.Errorf("read: got error %v, want TemporarilyUnavailable", err)
+			}
+		})
+	}
+}
+
+func TestCounter_lateKVReplies(t *testing.T) {
+	for _, mode := range []string{modeCAS, modeSharded} {
+		t.Run(mode, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			kv := &slowKV{KV: maelstromtest.NewKV(maelstrom.SeqKV, rand.New(rand.NewSource(1))), delay: 300 * time.Millisecond}
+			net.AddService(maelstrom.SeqKV, kv)
+
+			cfg := withMode(mode)
+			cfg.requestTimeout = 100 * time.Millisecond
+			setup := func(node *maelstrom.Node) { newServer(node, cfg) }
+			net.AddNodes(1, setup)
+			net.Start()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := net.Client().RPC(ctx, "n0", map[string]any{"type": "add", "delta": 1})
+			if code := maelstrom.ErrorCode(err); code != maelstrom.Timeout {
+				t.Errorf("add: got error %v, want Timeout", err)
+			}
+
+			// The KV replies once the add gave up. Restart waits for the
+			// old node to stop, so it hangs if a reply's callback blocks.
+			time.Sleep(400 * time.Millisecond)
+			net.Restart("n0", setup)
+		})
+	}
+}
+
+func TestCounter_staleOK(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	kv := &unreachableKV{KV: maelstromtest.NewKV(maelstrom.SeqKV, rand.New(rand.NewSource(1)))}
+	net.AddService(maelstrom.SeqKV, kv)
+
+	cfg := withMode(modeCAS)
+	cfg.requestTimeout = 200 * time.Millisecond
+	cfg.staleOK = true
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "add", "delta": 3}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	var resp readResponse
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "read"}, &resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	kv.down.Store(true)
+
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "add", "delta": 4}); maelstrom.ErrorCode(err) != maelstrom.Timeout {
+		t.Errorf("add: got error %v, want Timeout", err)
+	}
+
+	resp = readResponse{}
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "read"}, &resp); err != nil {
+		t.Fatalf("stale read: %v", err)
+	}
+	if resp.Value != 3 {
+		t.Errorf("stale read = %d, want last known value 3", resp.Value)
+	}
+}
+
+func TestCounter_namedCounters(t *testing.T) {
+	for _, mode := range []string{modeCAS, modeSharded, modeCRDT, modePN} {
+		t.Run(mode, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			net.AddKV(maelstrom.SeqKV).SetStaleRate(0.3)
+			net.AddNodes(3, func(node *maelstrom.Node) { newServer(node, withMode(mode)) })
+			net.Start()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Every node adds its own amount to each counter, so a counter
+			// mixing up adds of another one ends up with a different total.
+			deltas := map[string]int{"": 1, "tenant-a": 10, "tenant-b": 100}
+			var wg sync.WaitGroup
+			for _, id := range net.NodeIDs() {
+				for key, delta := range deltas {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						c := net.Client()
+						for range 3 {
+							body := map[string]any{"type": "add", "key": key, "delta": delta}
+							if _, err := c.RPC(ctx, id, body); err != nil {
+								t.Errorf("add %d to %q on %s: %v", delta, key, id, err)
+							}
+						}
+					}()
+				}
+			}
+			wg.Wait()
+
+			c := net.Client()
+			maelstromtest.Eventually(t, 5*time.Second, func() error {
+				for _, id := range net.NodeIDs() {
+					for key, delta := range deltas {
+						var resp readResponse
+						if err := c.RPCInto(ctx, id, map[string]any{"type": "read", "key": key}, &resp); err != nil {
+							return err
+						}
+						if want := 9 * delta; resp.Value != want {
+							return fmt.Errorf("%s read %d from %q, want %d", id, resp.Value, key, want)
+						}
+					}
+
+					var resp listCountersResponse
+					if err := c.RPCInto(ctx, id, map[string]any{"type": "list_counters"}, &resp); err != nil {
+						return err
+					}
+					if want := []string{"counter", "tenant-a", "tenant-b"}; !slices.Equal(resp.Counters, want) {
+						return fmt.Errorf("%s listed %v, want %v", id, resp.Counters, want)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestCounter_malformedKey(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.SeqKV)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, withMode(modeSharded)) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := net.Client().RPC(ctx, "n0", map[string]any{"type": "add", "key": "counter:n1", "delta": 1})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Fatalf("add: got error %v, want MalformedRequest", err)
+	}
+}
+
+// unreachableKV drops every request while down is set.
+type unreachableKV struct {
+	*maelstromtest.KV
+	down atomic.Bool
+}
+
+func (kv *unreachableKV) Handle(msg maelstrom.Message) any {
+	if kv.down.Load() {
+		return nil
+	}
+	return kv.KV.Handle(msg)
+}
+
+// slowKV answers every request after delay.
+type slowKV struct {
+	*maelstromtest.KV
+	delay time.Duration
+}
+
+func (kv *slowKV) Handle(msg maelstrom.Message) any {
+	time.Sleep(kv.delay)
+	return kv.KV.Handle(msg)
+}
+
+func withMode(mode string) config {
+	cfg := defaultConfig
+	cfg.mode = mode
+	return cfg
+}
+
+// addConcurrently adds deltas in order through every node, one client per
+// node.
+func addConcurrently(ctx context.Context, net *maelstromtest.Network, h *checker.History, deltas ...int) {
+	var wg sync.WaitGroup
+	for _, id := range net.NodeIDs() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			for _, delta := range deltas {
+				checker.Record(h, c.ID(), id, "add", delta, func() (any, error) {
+					return c.RPC(ctx, id, map[string]any{"type": "add", "delta": delta})
+				})
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// readAllAndCheck reads the counter from every node, requires all operations
+// to have succeeded and checks the history.
+func readAllAndCheck(ctx context.Context, t *testing.T, net *maelstromtest.Network, h *checker.History) {
+	t.Helper()
+
+	c := net.Client()
+	for _, id := range net.NodeIDs() {
+		checker.Record(h, c.ID(), id, "read", nil, func() (int, error) {
+			var resp readResponse
+			err := c.RPCInto(ctx, id, map[string]any{"type": "read"}, &resp)
+			return resp.Value, err
+		})
+	}
+
+	for _, op := range h.Ops() {
+		if op.Status != checker.OK {
+			t.Fatalf("%s %v on %s did not succeed", op.F, op.Value, op.Node)
+		}
+	}
+
+	if err := checker.CheckCounter(h); err != nil {
+		t.Error(err)
+	}
+}
+
+// waitForValue waits until every node reads want.
+func waitForValue(ctx context.Context, t *testing.T, net *maelstromtest.Network, want int) {
+	t.Helper()
+
+	c := net.Client()
+	maelstromtest.Eventually(t, 5*time.Second, func() error {
+		for _, id := range net.NodeIDs() {
+			var resp readResponse
+			if err := c.RPCInto(ctx, id, map[string]any{"type": "read"}, &resp); err != nil {
+				return err
+			}
+			if resp.Value != want {
+				return fmt.Errorf("%s read %d, want %d", id, resp.Value, want)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// shardedCounter keeps one SeqKV key per counter and node. A node only
+// writes its own keys, so adds never contend with other nodes, and a read
+// sums every node's key of the counter.
+type shardedCounter struct {
+	node  *maelstrom.Node
+	kv    *maelstromx.KV
+	index *counterIndex
+
+	// mu serializes the read-modify-write of the node's own keys.
+	mu      sync.Mutex
+	barrier int
+}
+
+func newShardedCounter(node *maelstrom.Node) *shardedCounter {
+	kv := maelstromx.NewSeqKV(node)
+
+	return &shardedCounter{
+		node:  node,
+		kv:    kv,
+		index: newCounterIndex(kv),
+	}
+}
+
+func shardKey(name, nodeID string) string {
+	return fmt.Sprintf("%s:%s", name, nodeID)
+}
+
+func (c *shardedCounter) add(ctx context.Context, name string, delta int) error {
+	if err := c.index.register(ctx, name); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// SeqKV always shows a client its own writes, and no other node writes
+	// this key, so the read is never stale.
+	key := shardKey(name, c.node.ID())
+	value, err := c.readShard(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return c.kv.Write(ctx, key, value+delta)
+}
+
+func (c *shardedCounter) read(ctx context.Context, name string) (int, error) {
+	if err := c.sync(ctx); err != nil {
+		return 0, err
+	}
+
+	sum := 0
+	for _, nodeID := range c.node.NodeIDs() {
+		value, err := c.readShard(ctx, shardKey(name, nodeID))
+		if err != nil {
+			return 0, err
+		}
+		sum += value
+	}
+
+	return sum, nil
+}
+
+// sync writes a fresh value to the node's barrier key. SeqKV orders the
+// write after everything written before it, and later reads by this node
+// can't observe an older state, so they see every add acknowledged before
+// the read started.
+func (c *shardedCounter) sync(ctx context.Context) error {
+	c.mu.Lock()
+	c.barrier++
+	barrier := c.barrier
+	c.mu.Unlock()
+
+	return c.kv.Write(ctx, ":barrier:"+c.node.ID(), barrier)
+}
+
+func (c *shardedCounter) list(ctx context.Context) ([]string, error) {
+	if err := c.sync(ctx); err != nil {
+		return nil, err
+	}
+
+	return c.index.list(ctx)
+}
+
+func (c *shardedCounter) readShard(ctx context.Context, key string) (int, error) {
+	value, err := c.kv.ReadInt(ctx, key)
+	if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+		return 0, nil
+	}
+	return value, err
+}
@@ -3,38 +3,104 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"maps"
+	"slices"
 	"sync"
 
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+type config struct {
+	retention kafka.Retention
+	wal       walConfig
+}
+
+var defaultConfig = config{
+	wal: defaultWALConfig,
+}
+
 func main() {
 	node := maelstrom.NewNode()
 
-	s := server{
-		node: node,
+	cfg := defaultConfig
+	retention, err := kafka.RetentionFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
+	cfg.retention = retention
 
-	node.Handle("send", s.handleSend)
-	node.Handle("poll", s.handlePoll)
-	node.Handle("commit_offsets", s.handleCommitOffsets)
-	node.Handle("list_committed_offsets", s.handleListCommittedOffsets)
+	if cfg.wal, err = walFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	s := newServer(node, cfg)
+	if cfg.wal.dir != "" {
+		if err := s.recoverWAL(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if err := node.Run(); err != nil {
+	err = node.Run()
+	if closeErr := s.close(); closeErr != nil {
+		log.Printf("close write-ahead log: %v", closeErr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newServer creates a server and registers its handlers on the node.
+func newServer(node *maelstrom.Node, cfg config) *server {
+	s := &server{
+		node: node,
+		cfg:  cfg,
+	}
+
+	maelstromx.Handle(node, "send", s.handleSend)
+	maelstromx.Handle(node, "send_batch", s.handleSendBatch)
+	maelstromx.Handle(node, "poll", s.handlePoll)
+	maelstromx.Handle(node, "commit_offsets", s.handleCommitOffsets)
+	maelstromx.Handle(node, "list_committed_offsets", s.handleListCommittedOffsets)
+	maelstromx.Handle(node, "list_groups", s.handleListGroups)
+	maelstromx.Handle(node, "delete_group", s.handleDeleteGroup)
+
+	return s
+}
+
+// close stops the background work of the server once the node stopped.
+func (s *server) close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
+}
+
 type server struct {
-	node *maelstrom.Node
+	node     *maelstrom.Node
+	cfg      config
+	notifier kafka.Notifier
+	// wal logs appended messages and committed offsets, unless it's nil.
+	wal *wal
 
 	mu   sync.Mutex
 	logs map[string]*logState
+	// groups holds the committed offset of every key per consumer group.
+	groups    map[string]map[string]int
+	sequences kafka.Sequences
 }
 
+// logState holds the retained messages of a key, which are the offsets
+// [next-len(messages), next).
 type logState struct {
-	messages  []logEntry
-	committed int
+	messages []logEntry
+	next     int
+}
+
+// first returns the lowest retained offset.
+func (l *logState) first() int {
+	return l.next - len(l.messages)
 }
 
 type logEntry struct {
@@ -42,60 +108,115 @@ type logEntry struct {
 	value  json.RawMessage
 }
 
-func (s *server) handleSend(msg maelstrom.Message) error {
-	var body struct {
-		Key string          `json:"key"`
-		Msg json.RawMessage `json:"msg"`
+func (s *server) handleSend(msg maelstrom.Message, req kafka.SendRequest) (kafka.SendResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, err := s.appendLocked(req)
+	if err != nil {
+		return kafka.SendResponse{}, err
 	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+	if err := s.flushWAL(); err != nil {
+		return kafka.SendResponse{}, err
 	}
 
-	msgCopy := json.RawMessage(append([]byte{}, body.Msg...))
+	return kafka.SendResponse{Offset: offset}, nil
+}
 
+// handleSendBatch appends all messages under one lock, so the new messages of
+// each key get consecutive offsets.
+func (s *server) handleSendBatch(msg maelstrom.Message, req kafka.SendBatchRequest) (kafka.SendBatchResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.sequences.CheckBatch(req.Msgs); err != nil {
+		return kafka.SendBatchResponse{}, err
+	}
+
+	offsets := make([]int, len(req.Msgs))
+	for i, m := range req.Msgs {
+		offset, err := s.appendLocked(m)
+		if err != nil {
+			return kafka.SendBatchResponse{}, err
+		}
+		offsets[i] = offset
+	}
+	if err := s.flushWAL(); err != nil {
+		return kafka.SendBatchResponse{}, err
+	}
+
+	return kafka.SendBatchResponse{Offsets: offsets}, nil
+}
+
+// appendLocked appends the message of req and returns its offset, or the
+// original offset if req is a retried send. s.mu must be held.
+func (s *server) appendLocked(req kafka.SendRequest) (int, error) {
+	if req.ProducerID != "" {
+		offset, ok, err := s.sequences.Lookup(req.ProducerID, req.Key, *req.Seq)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+
 	if s.logs == nil {
 		s.logs = make(map[string]*logState)
 	}
 
-	state, ok := s.logs[body.Key]
+	state, ok := s.logs[req.Key]
 	if !ok {
-		state = &logState{committed: -1}
-		s.logs[body.Key] = state
+		state = &logState{}
+		s.logs[req.Key] = state
+	}
+
+	offset := state.next
+	if s.wal != nil {
+		rec := walRecord{Offset: offset, Msg: req.Msg, ProducerID: req.ProducerID}
+		if req.Seq != nil {
+			rec.Seq = *req.Seq
+		}
+		if err := s.wal.append(req.Key, rec); err != nil {
+			// The record may be partly written.
+			return 0, maelstromx.Errorf(maelstrom.Timeout, "append to write-ahead log: %v", err)
+		}
 	}
 
-	offset := len(state.messages)
 	state.messages = append(state.messages, logEntry{
 		offset: offset,
-		value:  msgCopy,
+		value:  json.RawMessage(append([]byte{}, req.Msg...)),
 	})
-
-	response := map[string]any{
-		"type":   "send_ok",
-		"offset": offset,
+	state.next++
+	if req.ProducerID != "" {
+		s.sequences.Record(req.ProducerID, req.Key, *req.Seq, offset)
 	}
+	s.compact(req.Key)
+	s.notifier.Notify(req.Key)
 
-	return s.node.Reply(msg, response)
+	return offset, nil
 }
 
+// maxPollCount is how many messages a poll returns per key at most.
 const maxPollCount = 5
 
-func (s *server) handlePoll(msg maelstrom.Message) error {
-	var body struct {
-		Offsets map[string]int `json:"offsets"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
+func (s *server) handlePoll(msg maelstrom.Message, req kafka.PollRequest) (kafka.PollResponse, error) {
+	keys := slices.Collect(maps.Keys(req.Offsets))
+	return kafka.LongPoll(&s.notifier, keys, req.WaitMs, func() (kafka.PollResponse, bool, error) {
+		resp := s.poll(req.Offsets)
+		return resp, kafka.HasMessages(resp), nil
+	}, nil)
+}
 
+// poll returns up to maxPollCount messages of each key from its offset on.
+func (s *server) poll(offsets map[string]int) kafka.PollResponse {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	result := make(map[string][][]any, len(body.Offsets))
+	result := make(map[string][][]any, len(offsets))
+	var truncated map[string]int
 
-	for key, start := range body.Offsets {
+	for key, start := range offsets {
 		state, ok := s.logs[key]
 		if !ok {
 			result[key] = [][]any{}
@@ -105,13 +226,21 @@ func (s *server) handlePoll(msg maelstrom.Message) error {
 		if start < 0 {
 			start = 0
 		}
-		if start >= len(state.messages) {
+		if first := state.first(); start < first {
+			if truncated == nil {
+				truncated = map[string]int{}
+			}
+			truncated[key] = first
+			start = first
+		}
+		if start >= state.next {
 			result[key] = [][]any{}
 			continue
 		}
 
-		msgs := make([][]any, 0, len(state.messages)-start)
-		for i := start; i < len(state.messages) && i <= start+maxPollCount; i++ {
+		from := start - state.first()
+		msgs := make([][]any, 0, min(state.next-start, maxPollCount))
+		for i := from; i < len(state.messages) && i < from+maxPollCount; i++ {
 			entry := state.messages[i]
 			msgs = append(msgs, []any{entry.offset, entry.value})
 		}
@@ -119,70 +248,65 @@ func (s *server) handlePoll(msg maelstrom.Message) error {
 		result[key] = msgs
 	}
 
-	response := map[string]any{
-		"type": "poll_ok",
-		"msgs": result,
-	}
-
-	return s.node.Reply(msg, response)
+	return kafka.PollResponse{Msgs: result, Truncated: truncated}
 }
 
-func (s *server) handleCommitOffsets(msg maelstrom.Message) error {
-	var body struct {
-		Offsets map[string]int `json:"offsets"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
-
+func (s *server) handleCommitOffsets(msg maelstrom.Message, req kafka.CommitOffsetsRequest) (struct{}, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.logs == nil {
-		s.logs = make(map[string]*logState)
+	if s.groups == nil {
+		s.groups = make(map[string]map[string]int)
 	}
 
-	for key, offset := range body.Offsets {
-		state, ok := s.logs[key]
-		if !ok {
-			state = &logState{committed: -1}
-			s.logs[key] = state
-		}
-
-		if offset > state.committed {
-			state.committed = offset
-		}
+	group := kafka.GroupName(req.Group)
+	committed, ok := s.groups[group]
+	if !ok {
+		committed = make(map[string]int)
+		s.groups[group] = committed
 	}
 
-	response := map[string]any{
-		"type": "commit_offsets_ok",
+	for key, offset := range req.Offsets {
+		if current, ok := committed[key]; !ok || offset > current {
+			committed[key] = offset
+		}
+		s.compact(key)
 	}
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, s.saveGroupsLocked()
 }
 
-func (s *server) handleListCommittedOffsets(msg maelstrom.Message) error {
-	var body struct {
-		Keys []string `json:"keys"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
-
+func (s *server) handleListCommittedOffsets(msg maelstrom.Message, req kafka.ListCommittedOffsetsRequest) (kafka.OffsetsMsg, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	offsets := make(map[string]int, len(body.Keys))
-	for _, key := range body.Keys {
-		if state, ok := s.logs[key]; ok && state.committed >= 0 {
-			offsets[key] = state.committed
+	committed := s.groups[kafka.GroupName(req.Group)]
+
+	offsets := make(map[string]int, len(req.Keys))
+	for _, key := range req.Keys {
+		if offset, ok := committed[key]; ok {
+			offsets[key] = offset
 		}
 	}
 
-	response := map[string]any{
-		"type":    "list_committed_offsets_ok",
-		"offsets": offsets,
-	}
+	return kafka.OffsetsMsg{Offsets: offsets}, nil
+}
+
+func (s *server) handleListGroups(msg maelstrom.Message, req struct{}) (kafka.ListGroupsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := slices.AppendSeq([]string{}, maps.Keys(s.groups))
+	slices.Sort(groups)
+
+	return kafka.ListGroupsResponse{Groups: groups}, nil
+}
+
+func (s *server) handleDeleteGroup(msg maelstrom.Message, req kafka.DeleteGroupRequest) (struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.groups, kafka.GroupName(req.Group))
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, s.saveGroupsLocked()
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/kafkatest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestKafka(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+
+	for i, key := range []string{"a", "a", "b", "a"} {
+		var resp kafka.SendResponse
+		if err := c.RPCInto(ctx, "n0", map[string]any{"type": "send", "key": key, "msg": i}, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var poll struct {
+		Msgs map[string][][2]int `json:"msgs"`
+	}
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{"a": 1, "b": 0}}, &poll); err != nil {
+		t.Fatal(err)
+	}
+
+	wantMsgs := map[string][][2]int{
+		"a": {{1, 1}, {2, 3}},
+		"b": {{0, 2}},
+	}
+	if !reflect.DeepEqual(poll.Msgs, wantMsgs) {
+		t.Errorf("poll = %v, want %v", poll.Msgs, wantMsgs)
+	}
+
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "commit_offsets", "offsets": map[string]int{"a": 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var committed kafka.OffsetsMsg
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "list_committed_offsets", "keys": []string{"a", "b"}}, &committed); err != nil {
+		t.Fatal(err)
+	}
+
+	wantOffsets := map[string]int{"a": 2}
+	if !reflect.DeepEqual(committed.Offsets, wantOffsets) {
+		t.Errorf("list_committed_offsets = %v, want %v", committed.Offsets, wantOffsets)
+	}
+}
+
+func TestKafka_pollLimit(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for i := range maxPollCount + 2 {
+		if _, err := c.RPC(ctx, "n0", map[string]any{"type": "send", "key": "a", "msg": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct{ offset, want int }{{0, maxPollCount}, {3, 4}} {
+		var poll struct {
+			Msgs map[string][][2]int `json:"msgs"`
+		}
+		if err := c.RPCInto(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{"a": tt.offset}}, &poll); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(poll.Msgs["a"]); got != tt.want || poll.Msgs["a"][0][0] != tt.offset {
+			t.Errorf("poll from %d = %v, want %d messages from %d", tt.offset, poll.Msgs["a"], tt.want, tt.offset)
+		}
+	}
+}
+
+func TestKafka_malformedSend(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for name, body := range map[string]map[string]any{
+		"missing key": {"type": "send", "msg": 1},
+		"missing msg": {"type": "send", "key": "a"},
+	} {
+		_, err := c.RPC(ctx, "n0", body)
+		if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+			t.Errorf("send with %s: error code = %d, want %d", name, code, maelstrom.MalformedRequest)
+		}
+	}
+
+	// Rejected sends must leave the key readable.
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{"a": 0}}); err != nil {
+		t.Errorf("poll after rejected sends: %v", err)
+	}
+}
+
+func TestKafka_concurrentClients(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var h checker.History
+	keys := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			for j := range 20 {
+				send := checker.KafkaSend{Key: keys[j%len(keys)], Msg: i*100 + j}
+				checker.Record(&h, c.ID(), "n0", "send", send, func() (int, error) {
+					var resp kafka.SendResponse
+					err := c.RPCInto(ctx, "n0", map[string]any{"type": "send", "key": send.Key, "msg": send.Msg}, &resp)
+					return resp.Offset, err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := net.Client()
+	offsets := map[string]int{"a": 0, "b": 0, "c": 0}
+	seen := 0
+	for seen < 80 {
+		start := maps.Clone(offsets)
+		msgs, err := checker.Record(&h, c.ID(), "n0", "poll", start, func() (checker.KafkaMsgs, error) {
+			var resp struct {
+				Msgs checker.KafkaMsgs `json:"msgs"`
+			}
+			err := c.RPCInto(ctx, "n0", map[string]any{"type": "poll", "offsets": start}, &resp)
+			return resp.Msgs, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		polled := 0
+		for key, pairs := range msgs {
+			for _, pair := range pairs {
+				offsets[key] = pair[0] + 1
+				polled++
+			}
+		}
+		if polled == 0 {
+			t.Fatalf("poll from %v returned nothing after %d of 80 messages", start, seen)
+		}
+		seen += polled
+	}
+
+	if err := checker.CheckKafka(&h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKafka_consumerGroups(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kafkatest.ConsumerGroups(ctx, t, net.Client(), "n0")
+}
+
+func TestKafka_retention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention kafka.Retention
+		// commits are made in order, as a group can only hold back
+		// truncation once it exists.
+		commits []kafka.CommitOffsetsRequest
+		// first is the first offset a poll of "a" from 0 returns.
+		first int
+	}{
+		{
+			name:  "unlimited",
+			first: 0,
+		},
+		{
+			name:      "max messages",
+			retention: kafka.Retention{MaxMessages: 3},
+			first:     7,
+		},
+		{
+			name:      "below committed",
+			retention: kafka.Retention{BelowCommitted: true},
+			commits:   []kafka.CommitOffsetsRequest{{Group: "one", Offsets: map[string]int{"a": 4}}, {Group: "two", Offsets: map[string]int{"a": 6}}},
+			first:     4,
+		},
+		{
+			name:      "group without commit for key",
+			retention: kafka.Retention{BelowCommitted: true},
+			commits:   []kafka.CommitOffsetsRequest{{Group: "two", Offsets: map[string]int{"b": 6}}, {Group: "one", Offsets: map[string]int{"a": 4}}},
+			first:     0,
+		},
+		{
+			name:      "both policies",
+			retention: kafka.Retention{MaxMessages: 8, BelowCommitted: true},
+			commits:   []kafka.CommitOffsetsRequest{{Group: "one", Offsets: map[string]int{"a": 1}}},
+			first:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			net := maelstromtest.NewNetwork(t)
+			net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, config{retention: tt.retention}) })
+			net.Start()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c := net.Client()
+			for i := range 10 {
+				if _, err := c.RPC(ctx, "n0", map[string]any{"type": "send", "key": "a", "msg": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, commit := range tt.commits {
+				if _, err := c.RPC(ctx, "n0", map[string]any{"type": "commit_offsets", "group": commit.Group, "offsets": commit.Offsets}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var resp struct {
+				Msgs      map[string][][2]int `json:"msgs"`
+				Truncated map[string]int      `json:"truncated"`
+			}
+			if err := c.RPCInto(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{"a": 0}}, &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if msgs := resp.Msgs["a"]; len(msgs) == 0 || msgs[0] != [2]int{tt.first, tt.first} {
+				t.Errorf("poll from 0 = %v, want messages from offset %d", msgs, tt.first)
+			}
+
+			wantTruncated := map[string]int{}
+			if tt.first > 0 {
+				wantTruncated["a"] = tt.first
+			}
+			if !maps.Equal(resp.Truncated, wantTruncated) {
+				t.Errorf("truncated = %v, want %v", resp.Truncated, wantTruncated)
+			}
+		})
+	}
+}
+
+func TestKafka_longPoll(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	poll := func(waitMs int) (map[string][][2]int, time.Duration) {
+		t.Helper()
+
+		var resp struct {
+			Msgs map[string][][2]int `json:"msgs"`
+		}
+		start := time.Now()
+		body := map[string]any{"type": "poll", "offsets": map[string]int{"a": 0, "b": 0}, "wait_ms": waitMs}
+		if err := net.Client().RPCInto(ctx, "n0", body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Msgs, time.Since(start)
+	}
+
+	// Without messages the poll is answered when wait_ms runs out.
+	if msgs, elapsed := poll(100); len(msgs["a"])+len(msgs["b"]) != 0 || elapsed < 100*time.Millisecond {
+		t.Errorf("poll of empty logs returned %v after %v, want no messages after 100ms", msgs, elapsed)
+	}
+
+	// Messages of other keys don't wake the poll up.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := c.RPC(ctx, "n0", map[string]any{"type": "send", "key": "c", "msg": 1}); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, err := c.RPC(ctx, "n0", map[string]any{"type": "send", "key": "b", "msg": 2}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	msgs, elapsed := poll(3000)
+	if want := [][2]int{{0, 2}}; !reflect.DeepEqual(msgs["b"], want) {
+		t.Errorf("parked poll returned %v, want b: %v", msgs, want)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("parked poll returned after %v, want after the send to b", elapsed)
+	}
+
+	_, err := c.RPC(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{"a": 0}, "wait_ms": -1})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Errorf("poll with negative wait_ms: got error %v, want MalformedRequest", err)
+	}
+}
+
+func TestKafka_idempotentSend(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kafkatest.IdempotentSend(ctx, t, net.Client(), []string{"n0"})
+}
+
+func TestKafka_sendBatch(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kafkatest.SendBatch(ctx, t, net.Client(), []string{"n0"})
+}
+
+func TestKafka_restart(t *testing.T) {
+	cfg := defaultConfig
+	cfg.wal = walConfig{dir: t.TempDir(), sync: syncAlways, segmentBytes: 512}
+	// The previous server is closed once its node stopped, as main does.
+	var prev *server
+	setup := func(node *maelstrom.Node) {
+		if prev != nil {
+			if err := prev.close(); err != nil {
+				t.Error(err)
+			}
+		}
+
+		prev = newServer(node, cfg)
+		if err := prev.recoverWAL(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, setup)
+	net.Start()
+	t.Cleanup(func() { prev.close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commits := []map[string]any{
+		{"type": "commit_offsets", "offsets": map[string]int{"a": 1}},
+		{"type": "commit_offsets", "group": "g1", "offsets": map[string]int{"a": 2, "b": 3}},
+		{"type": "commit_offsets", "group": "g2", "offsets": map[string]int{"c": 4}},
+		{"type": "delete_group", "group": "g2"},
+	}
+	for _, body := range commits {
+		if _, err := net.Client().RPC(ctx, "n0", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// acked maps the offsets of acknowledged sends to their messages.
+	var mu sync.Mutex
+	acked := map[string]map[int]int{"a": {}, "b": {}, "c": {}}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key, value := []string{"a", "b", "c"}[(i+j)%3], i*10000+j
+				// Sends to a killed node are lost, so they time out and
+				// aren't acknowledged.
+				sendCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				var resp kafka.SendResponse
+				err := c.RPCInto(sendCtx, "n0", map[string]any{"type": "send", "key": key, "msg": value}, &resp)
+				cancel()
+				if err != nil {
+					continue
+				}
+
+				mu.Lock()
+				if prev, ok := acked[key][resp.Offset]; ok {
+					t.Errorf("offset %d of %s acknowledged for %d and %d", resp.Offset, key, prev, value)
+				}
+				acked[key][resp.Offset] = value
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		net.Restart("n0", setup)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	c := net.Client()
+	for key, want := range acked {
+		if len(want) == 0 {
+			t.Fatalf("no sends to %s were acknowledged", key)
+		}
+
+		got := map[int]int{}
+		for offset := 0; ; {
+			var resp struct {
+				Msgs map[string][][2]int `json:"msgs"`
+			}
+			if err := c.RPCInto(ctx, "n0", map[string]any{"type": "poll", "offsets": map[string]int{key: offset}}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			msgs := resp.Msgs[key]
+			if len(msgs) == 0 {
+				break
+			}
+			for _, m := range msgs {
+				got[m[0]] = m[1]
+			}
+			offset = msgs[len(msgs)-1][0] + 1
+		}
+
+		for offset, value := range want {
+			if got[offset] != value {
+				t.Errorf("offset %d of %s holds %d after restarts, want acknowledged %d", offset, key, got[offset], value)
+			}
+		}
+	}
+
+	var groups kafka.ListGroupsResponse
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "list_groups"}, &groups); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{kafka.DefaultGroup, "g1"}; !slices.Equal(groups.Groups, want) {
+		t.Errorf("groups after restarts = %v, want %v", groups.Groups, want)
+	}
+
+	for group, want := range map[string]map[string]int{"": {"a": 1}, "g1": {"a": 2, "b": 3}} {
+		var resp kafka.OffsetsMsg
+		req := map[string]any{"type": "list_committed_offsets", "group": group, "keys": []string{"a", "b", "c"}}
+		if err := c.RPCInto(ctx, "n0", req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(resp.Offsets, want) {
+			t.Errorf("offsets committed by %q after restarts = %v, want %v", group, resp.Offsets, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "log"
+
+// compact drops the messages of key the retention policy no longer keeps.
+// s.mu must be held.
+func (s *server) compact(key string) {
+	state, ok := s.logs[key]
+	if !ok {
+		return
+	}
+
+	first := state.first()
+	keep := first
+	if s.cfg.retention.MaxMessages > 0 {
+		keep = max(keep, state.next-s.cfg.retention.MaxMessages)
+	}
+	if committed, ok := s.minCommitted(key); ok && s.cfg.retention.BelowCommitted {
+		keep = max(keep, min(committed, state.next))
+	}
+
+	if drop := keep - first; drop > 0 {
+		// Clear the dropped entries so they can be collected before append
+		// reallocates the slice.
+		clear(state.messages[:drop])
+		state.messages = state.messages[drop:]
+
+		if s.wal != nil {
+			if err := s.wal.truncate(key, state.first()); err != nil {
+				log.Printf("truncate write-ahead log of %q: %v", key, err)
+			}
+		}
+	}
+}
+
+// minCommitted returns the lowest offset committed for key across consumer
+// groups. ok is false if some group didn't commit the key. s.mu must be held.
+func (s *server) minCommitted(key string) (offset int, ok bool) {
+	if len(s.groups) == 0 {
+		return 0, false
+	}
+
+	first := true
+	for _, committed := range s.groups {
+		groupOffset, ok := committed[key]
+		if !ok {
+			return 0, false
+		}
+		if first || groupOffset < offset {
+			offset = groupOffset
+		}
+		first = false
+	}
+
+	return offset, true
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// syncPolicy decides when the write-ahead log is flushed to disk. Records
+// are written before their sends are acknowledged under every policy, so a
+// crash of the process alone never loses acknowledged sends.
+type syncPolicy string
+
+const (
+	// syncAlways flushes records before their sends are acknowledged.
+	syncAlways syncPolicy = "always"
+	// syncInterval flushes every walSyncInterval, so a machine crash loses
+	// the sends acknowledged since.
+	syncInterval syncPolicy = "interval"
+	// syncNever leaves flushing to the operating system.
+	syncNever syncPolicy = "never"
+)
+
+const walSyncInterval = 100 * time.Millisecond
+
+type walConfig struct {
+	// dir holds a directory of segments per key. The log is off if dir is
+	// empty.
+	dir  string
+	sync syncPolicy
+	// segmentBytes is the size at which a segment is closed and the next
+	// record of the key starts a new one.
+	segmentBytes int64
+}
+
+var defaultWALConfig = walConfig{
+	sync:         syncAlways,
+	segmentBytes: 1 << 20,
+}
+
+// walFromEnv reads the write-ahead log settings from KAFKA_WAL_DIR,
+// KAFKA_WAL_SYNC and KAFKA_WAL_SEGMENT_BYTES.
+func walFromEnv() (walConfig, error) {
+	cfg := defaultWALConfig
+	cfg.dir = os.Getenv("KAFKA_WAL_DIR")
+
+	if policy := os.Getenv("KAFKA_WAL_SYNC"); policy != "" {
+		cfg.sync = syncPolicy(policy)
+		switch cfg.sync {
+		case syncAlways, syncInterval, syncNever:
+		default:
+			return cfg, fmt.Errorf("invalid KAFKA_WAL_SYNC %q", policy)
+		}
+	}
+
+	if size := os.Getenv("KAFKA_WAL_SEGMENT_BYTES"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid KAFKA_WAL_SEGMENT_BYTES %q", size)
+		}
+		cfg.segmentBytes = n
+	}
+
+	return cfg, nil
+}
+
+// groupsFile holds the committed offsets of every consumer group next to the
+// key directories. It's replaced as a whole by renaming groupsTempFile over
+// it on every change.
+const (
+	groupsFile     = "groups.json"
+	groupsTempFile = "groups.json.tmp"
+)
+
+// walRecord is an appended message. Retried sends aren't logged again.
+type walRecord struct {
+	Offset     int             `json:"offset"`
+	Msg        json.RawMessage `json:"msg"`
+	ProducerID string          `json:"producer_id,omitempty"`
+	Seq        int             `json:"seq,omitempty"`
+}
+
+// A record is stored as the length and the CRC-32C of its JSON encoding,
+// both big-endian uint32, followed by the encoding.
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is returned for a record that was cut short or doesn't
+// match its checksum, as left behind by a crash in the middle of a write.
+var errTornRecord = errors.New("torn record")
+
+func encodeRecord(rec walRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	return append(buf, payload...), nil
+}
+
+// decodeRecord decodes the record at the start of data and returns it with
+// its size.
+func decodeRecord(data []byte) (walRecord, int, error) {
+	if len(data) < recordHeaderSize {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if len(data)-recordHeaderSize < size {
+		return walRecord{}, 0, errTornRecord
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+size]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return walRecord{}, 0, fmt.Errorf("decode record: %w", err)
+	}
+	return rec, recordHeaderSize + size, nil
+}
+
+// wal is a write-ahead log of the messages of every key. The records of a
+// key are stored in its own directory, in segment files named after the
+// offset of their first record.
+type wal struct {
+	cfg walConfig
+	// stop ends the interval sync loop.
+	stop chan struct{}
+
+	mu   sync.Mutex
+	keys map[string]*segments
+	// err is the first failed write. The log refuses appends from then on,
+	// as they could follow a partial record that replay stops at.
+	err error
+}
+
+type segments struct {
+	dir string
+	// bases holds the first offset of every segment in order. Records are
+	// appended to the last one, which is open as file.
+	bases []int
+	file  *os.File
+	size  int64
+	dirty bool
+}
+
+// openWAL opens the log in cfg.dir and passes every record to replay, in
+// order for each key. A torn record at the end of the last segment of a key
+// is cut off; one anywhere else is an error.
+func openWAL(cfg walConfig, replay func(key string, rec walRecord) error) (*wal, error) {
+	if err := os.MkdirAll(cfg.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(cfg.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{cfg: cfg, keys: map[string]*segments{}, stop: make(chan struct{})}
+	for _, entry := range entries {
+		if entry.Name() == groupsFile || entry.Name() == groupsTempFile {
+			continue
+		}
+
+		key, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			return nil, fmt.Errorf("unexpected %s in write-ahead log", entry.Name())
+		}
+
+		segs, err := loadSegments(filepath.Join(cfg.dir, entry.Name()), func(rec walRecord) error {
+			return replay(string(key), rec)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("replay %q: %w", key, err)
+		}
+		w.keys[string(key)] = segs
+	}
+
+	if cfg.sync == syncInterval {
+		go w.syncPeriodically()
+	}
+
+	return w, nil
+}
+
+// loadSegments replays the segments in dir and opens the last one for
+// appends.
+func loadSegments(dir string, replay func(rec walRecord) error) (*segments, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segs := &segments{dir: dir}
+	for _, entry := range entries {
+		base, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".log"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".log") {
+			return nil, fmt.Errorf("unexpected segment %s", entry.Name())
+		}
+		segs.bases = append(segs.bases, base)
+	}
+	slices.Sort(segs.bases)
+
+	for i, base := range segs.bases {
+		path := segs.path(base)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var pos int
+		for pos < len(data) {
+			rec, n, err := decodeRecord(data[pos:])
+			if errors.Is(err, errTornRecord) && i == len(segs.bases)-1 {
+				log.Printf("cutting off torn record at %d of %s", pos, path)
+				if err := os.Truncate(path, int64(pos)); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("segment %d at %d: %w", base, pos, err)
+			}
+
+			if err := replay(rec); err != nil {
+				return nil, err
+			}
+			pos += n
+		}
+
+		if i == len(segs.bases)-1 {
+			if segs.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+				return nil, err
+			}
+			segs.size = int64(pos)
+		}
+	}
+
+	return segs, nil
+}
+
+func (s *segments) path(base int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.log", base))
+}
+
+// append writes rec to the log of key. It's flushed according to the sync
+// policy, by flush or in the background.
+func (w *wal) append(key string, rec walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	segs, ok := w.keys[key]
+	if !ok {
+		segs = &segments{dir: filepath.Join(w.cfg.dir, hex.EncodeToString([]byte(key)))}
+		w.keys[key] = segs
+	}
+
+	if segs.file == nil || segs.size >= w.cfg.segmentBytes {
+		if err := w.roll(segs, rec.Offset); err != nil {
+			w.err = fmt.Errorf("start segment %d of %q: %w", rec.Offset, key, err)
+			return w.err
+		}
+	}
+
+	// A single write, so a crash leaves at most one torn record at the end.
+	if _, err := segs.file.Write(buf); err != nil {
+		w.err = fmt.Errorf("write record %d of %q: %w", rec.Offset, key, err)
+		return w.err
+	}
+	segs.size += int64(len(buf))
+	segs.dirty = true
+
+	return nil
+}
+
+// roll closes the current segment of segs and starts a new one at base.
+// Closed segments are always flushed, so only the last segment of a key can
+// end with a torn record. w.mu must be held.
+func (w *wal) roll(segs *segments, base int) error {
+	if segs.file != nil {
+		if err := segs.file.Sync(); err != nil {
+			return err
+		}
+		if err := segs.file.Close(); err != nil {
+			return err
+		}
+		segs.file = nil
+	}
+
+	if err := os.MkdirAll(segs.dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(segs.path(base), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	segs.bases = append(segs.bases, base)
+	segs.file = file
+	segs.size = 0
+
+	if w.cfg.sync != syncNever {
+		// Flush the directory too, or the new segment may be lost with
+		// the records in it.
+		return syncDir(segs.dir)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// flush flushes the appended records to disk if the sync policy requires it
+// before sends are acknowledged.
+func (w *wal) flush() error {
+	if w.cfg.sync != syncAlways {
+		return nil
+	}
+	return w.sync()
+}
+
+// sync flushes the records appended since the last sync to disk.
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	for key, segs := range w.keys {
+		if !segs.dirty {
+			continue
+		}
+		if err := segs.file.Sync(); err != nil {
+			w.err = fmt.Errorf("sync %q: %w", key, err)
+			return w.err
+		}
+		segs.dirty = false
+	}
+
+	return nil
+}
+
+func (w *wal) syncPeriodically() {
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := w.sync(); err != nil {
+			log.Printf("sync write-ahead log: %v", err)
+		}
+	}
+}
+
+// close stops the interval sync loop, flushes what's left and closes the
+// segments. The log must not be appended to afterwards.
+func (w *wal) close() error {
+	close(w.stop)
+
+	err := w.sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, segs := range w.keys {
+		if segs.file != nil {
+			err = errors.Join(err, segs.file.Close())
+			segs.file = nil
+		}
+	}
+	if w.err == nil {
+		w.err = errors.New("write-ahead log is closed")
+	}
+
+	return err
+}
+
+// saveGroups replaces the stored committed offsets with groups. Unless the
+// sync policy is never, they're flushed before it returns.
+func (w *wal) saveGroups(groups map[string]map[string]int) error {
+	data, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(w.cfg.dir, groupsTempFile)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && w.cfg.sync != syncNever {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(w.cfg.dir, groupsFile)); err != nil {
+		return err
+	}
+	if w.cfg.sync != syncNever {
+		return syncDir(w.cfg.dir)
+	}
+	return nil
+}
+
+// loadGroups returns the committed offsets stored in dir, which are none
+// before the first commit.
+func loadGroups(dir string) (map[string]map[string]int, error) {
+	groups := map[string]map[string]int{}
+
+	data, err := os.ReadFile(filepath.Join(dir, groupsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return groups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", groupsFile, err)
+	}
+	return groups, nil
+}
+
+// truncate deletes the segments of key that only hold records below offset.
+func (w *wal) truncate(key string, offset int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segs, ok := w.keys[key]
+	if !ok {
+		return nil
+	}
+
+	for len(segs.bases) > 1 && segs.bases[1] <= offset {
+		if err := os.Remove(segs.path(segs.bases[0])); err != nil {
+			return err
+		}
+		segs.bases = segs.bases[1:]
+	}
+
+	return nil
+}
+
+// recoverWAL replays the write-ahead log into the logs and logs later sends
+// and commits to it. It must be called before the node runs.
+func (s *server) recoverWAL() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Committed offsets are loaded first, so replayed messages are
+	// compacted below them as they were before the restart.
+	groups, err := loadGroups(s.cfg.wal.dir)
+	if err != nil {
+		return err
+	}
+	s.groups = groups
+
+	w, err := openWAL(s.cfg.wal, s.replayLocked)
+	if err != nil {
+		return err
+	}
+	s.wal = w
+
+	return nil
+}
+
+// replayLocked appends a logged message. s.mu must be held.
+func (s *server) replayLocked(key string, rec walRecord) error {
+	if s.logs == nil {
+		s.logs = make(map[string]*logState)
+	}
+
+	state, ok := s.logs[key]
+	if !ok {
+		// Retention may have deleted the first segments.
+		state = &logState{next: rec.Offset}
+		s.logs[key] = state
+	}
+	if rec.Offset != state.next {
+		return fmt.Errorf("record %d follows offset %d", rec.Offset, state.next-1)
+	}
+
+	state.messages = append(state.messages, logEntry{offset: rec.Offset, value: rec.Msg})
+	state.next++
+	if rec.ProducerID != "" {
+		s.sequences.Record(rec.ProducerID, key, rec.Seq, rec.Offset)
+	}
+	s.compact(key)
+
+	return nil
+}
+
+// saveGroupsLocked stores the committed offsets before a commit or a group
+// deletion is answered. s.mu must be held.
+func (s *server) saveGroupsLocked() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.wal.saveGroups(s.groups); err != nil {
+		// The change is made in memory, but may not survive a restart.
+		return maelstromx.Errorf(maelstrom.Timeout, "save consumer groups: %v", err)
+	}
+	return nil
+}
+
+// flushWAL flushes the sends appended by a request before it's answered.
+func (s *server) flushWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.wal.flush(); err != nil {
+		// The sends are appended in memory, but may not survive a crash.
+		return maelstromx.Errorf(maelstrom.Timeout, "flush write-ahead log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// replayAll opens the log in dir and returns the replayed records by key.
+func replayAll(t *testing.T, cfg walConfig) (*wal, map[string][]walRecord) {
+	t.Helper()
+
+	records := map[string][]walRecord{}
+	w, err := openWAL(cfg, func(key string, rec walRecord) error {
+		records[key] = append(records[key], rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("open write-ahead log: %v", err)
+	}
+	return w, records
+}
+
+func appendRecords(t *testing.T, w *wal, key string, from, to int) []walRecord {
+	t.Helper()
+
+	var recs []walRecord
+	for offset := from; offset < to; offset++ {
+		rec := walRecord{Offset: offset, Msg: json.RawMessage(fmt.Sprint(offset * 10))}
+		if err := w.append(key, rec); err != nil {
+			t.Fatalf("append %d to %q: %v", offset, key, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	return recs
+}
+
+func segmentFiles(t *testing.T, cfg walConfig, key string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(cfg.dir, fmt.Sprintf("%x", key), "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWAL_replay(t *testing.T) {
+	cfg := walConfig{dir: t.TempDir(), sync: syncAlways, segmentBytes: 100}
+
+	w, records := replayAll(t, cfg)
+	if len(records) != 0 {
+		t.Fatalf("empty log replayed %v", records)
+	}
+
+	want := map[string][]walRecord{
+		"a":     appendRecords(t, w, "a", 0, 20),
+		"../b/": appendRecords(t, w, "../b/", 0, 3),
+	}
+	if got := len(segmentFiles(t, cfg, "a")); got < 2 {
+		t.Errorf("a has %d segments, want several", got)
+	}
+
+	w, records = replayAll(t, cfg)
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+
+	// Appends continue where the replayed log ends.
+	want["a"] = append(want["a"], appendRecords(t, w, "a", 20, 25)...)
+	if _, records = replayAll(t, cfg); !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v after more appends, want %v", records, want)
+	}
+}
+
+func TestWAL_tornRecord(t *testing.T) {
+	cfg := walConfig{dir: t.TempDir(), sync: syncAlways, segmentBytes: 1 << 20}
+
+	w, _ := replayAll(t, cfg)
+	want := appendRecords(t, w, "a", 0, 3)
+
+	// A crash in the middle of a write leaves part of a record behind.
+	rec, err := encodeRecord(walRecord{Offset: 3, Msg: json.RawMessage("30")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := segmentFiles(t, cfg, "a")[0]
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(rec[:len(rec)-2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w, records := replayAll(t, cfg)
+	if !reflect.DeepEqual(records["a"], want) {
+		t.Errorf("replayed %v, want %v", records["a"], want)
+	}
+
+	want = append(want, appendRecords(t, w, "a", 3, 5)...)
+	if _, records = replayAll(t, cfg); !reflect.DeepEqual(records["a"], want) {
+		t.Errorf("replayed %v after appending past the torn record, want %v", records["a"], want)
+	}
+}
+
+func TestWAL_corruptSegment(t *testing.T) {
+	cfg := walConfig{dir: t.TempDir(), sync: syncAlways, segmentBytes: 100}
+
+	w, _ := replayAll(t, cfg)
+	appendRecords(t, w, "a", 0, 20)
+
+	// Only the last segment can end with a torn record, a checksum
+	// mismatch anywhere else is corruption.
+	segment := segmentFiles(t, cfg, "a")[0]
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[recordHeaderSize+1] ^= 0xff
+	if err := os.WriteFile(segment, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openWAL(cfg, func(string, walRecord) error { return nil }); err == nil {
+		t.Error("opened a log with a corrupt segment")
+	}
+}
+
+func TestWAL_truncate(t *testing.T) {
+	cfg := walConfig{dir: t.TempDir(), sync: syncAlways, segmentBytes: 100}
+
+	w, _ := replayAll(t, cfg)
+	want := appendRecords(t, w, "a", 0, 20)
+	segments := len(segmentFiles(t, cfg, "a"))
+
+	if err := w.truncate("a", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := len(segmentFiles(t, cfg, "a"))
+	if remaining >= segments || remaining == 0 {
+		t.Errorf("truncate left %d of %d segments", remaining, segments)
+	}
+
+	// Only whole segments below the offset are deleted.
+	_, records := replayAll(t, cfg)
+	first := records["a"][0].Offset
+	if first > 10 || !reflect.DeepEqual(records["a"], want[first:]) {
+		t.Errorf("replayed %v after truncating below 10, want a suffix of %v including 10", records["a"], want)
+	}
+}
+
+func TestWAL_groups(t *testing.T) {
+	cfg := walConfig{dir: t.TempDir(), sync: syncInterval, segmentBytes: 100}
+
+	if groups, err := loadGroups(cfg.dir); err != nil || len(groups) != 0 {
+		t.Fatalf("load groups before any commit = %v, %v, want none", groups, err)
+	}
+
+	w, _ := replayAll(t, cfg)
+	want := appendRecords(t, w, "a", 0, 3)
+	groups := map[string]map[string]int{"default": {"a": 1}, "g1": {"a": 2, "b": 0}}
+	if err := w.saveGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.append("a", walRecord{Offset: 3, Msg: json.RawMessage("30")}); err == nil {
+		t.Error("appended to a closed log")
+	}
+
+	// The groups file sits next to the key directories.
+	if _, records := replayAll(t, cfg); !reflect.DeepEqual(records, map[string][]walRecord{"a": want}) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+	if got, err := loadGroups(cfg.dir); err != nil || !reflect.DeepEqual(got, groups) {
+		t.Errorf("load groups = %v, %v, want %v", got, err, groups)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// groupsKey holds the groupIndex.
+const groupsKey = "groups"
+
+// kvTimeout bounds the lin-kv requests of a single group request. Once it
+// passed, the request fails with a Timeout error.
+const kvTimeout = 1000 * time.Millisecond
+
+// groupIndex maps every consumer group to its generation. Committed offsets
+// are stored per generation, so deleting a group only removes it from the
+// index, and a group created again under the same name starts from a new
+// generation without offsets.
+type groupIndex struct {
+	NextGeneration int            `json:"next_generation"`
+	Groups         map[string]int `json:"groups"`
+}
+
+func (s *server) readGroups(ctx context.Context) (groupIndex, error) {
+	index := groupIndex{Groups: map[string]int{}}
+	if err := s.kv.ReadInto(ctx, groupsKey, &index); err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return groupIndex{Groups: map[string]int{}}, nil
+		}
+		return groupIndex{}, err
+	}
+
+	if index.Groups == nil {
+		index.Groups = map[string]int{}
+	}
+	return index, nil
+}
+
+// updateGroups applies update to the index with a CAS, retrying on
+// conflicts. update reports whether it changed the index.
+func (s *server) updateGroups(ctx context.Context, update func(index *groupIndex) bool) (groupIndex, error) {
+	for {
+		current, err := s.readGroups(ctx)
+		if err != nil {
+			return groupIndex{}, err
+		}
+
+		next := groupIndex{NextGeneration: current.NextGeneration, Groups: maps.Clone(current.Groups)}
+		if !update(&next) {
+			return current, nil
+		}
+
+		if err := s.kv.CompareAndSwap(ctx, groupsKey, current, next, true); err != nil {
+			if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+				continue
+			}
+			return groupIndex{}, err
+		}
+
+		return next, nil
+	}
+}
+
+// groupGeneration returns the generation of group, creating the group first
+// if create is set. ok is false for groups that don't exist.
+func (s *server) groupGeneration(ctx context.Context, group string, create bool) (generation int, ok bool, err error) {
+	index, err := s.readGroups(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if generation, ok := index.Groups[group]; ok || !create {
+		return generation, ok, nil
+	}
+
+	index, err = s.updateGroups(ctx, func(index *groupIndex) bool {
+		if _, ok := index.Groups[group]; ok {
+			return false
+		}
+		index.Groups[group] = index.NextGeneration
+		index.NextGeneration++
+		return true
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return index.Groups[group], true, nil
+}
+
+func (s *server) listGroups(ctx context.Context) ([]string, error) {
+	index, err := s.readGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := slices.AppendSeq([]string{}, maps.Keys(index.Groups))
+	slices.Sort(groups)
+	return groups, nil
+}
+
+func (s *server) deleteGroup(ctx context.Context, group string) error {
+	_, err := s.updateGroups(ctx, func(index *groupIndex) bool {
+		if _, ok := index.Groups[group]; !ok {
+			return false
+		}
+		delete(index.Groups, group)
+		return true
+	})
+	return err
+}
@@ -2,204 +2,365 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+type config struct {
+	// pollLimit caps the messages a poll returns per key.
+	pollLimit int
+	// chunkSize is how many consecutive offsets are stored together.
+	chunkSize   int
+	retention   kafka.Retention
+	replication replicationConfig
+}
+
+var defaultConfig = config{
+	pollLimit:   100,
+	chunkSize:   100,
+	replication: defaultReplicationConfig,
+}
+
 func main() {
 	node := maelstrom.NewNode()
-	kv := maelstrom.NewLinKV(node)
 
-	s := server{
-		node: node,
-		kv:   kv,
+	cfg := defaultConfig
+	if limit := os.Getenv("KAFKA_POLL_LIMIT"); limit != "" {
+		var err error
+		if cfg.pollLimit, err = strconv.Atoi(limit); err != nil || cfg.pollLimit < 1 {
+			log.Fatalf("invalid KAFKA_POLL_LIMIT %q", limit)
+		}
+	}
+
+	retention, err := kafka.RetentionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.retention = retention
+
+	if cfg.replication, err = replicationFromEnv(); err != nil {
+		log.Fatal(err)
 	}
 
-	node.Handle("send", s.handleSend)
-	node.Handle("poll", s.handlePoll)
-	node.Handle("commit_offsets", s.handleCommitOffsets)
-	node.Handle("list_committed_offsets", s.handleListCommittedOffsets)
+	newServer(node, cfg)
 
 	if err := node.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-type server struct {
-	node *maelstrom.Node
-	kv   *maelstrom.KV
-}
+// newServer creates a server and registers its handlers on the node.
+func newServer(node *maelstrom.Node, cfg config) *server {
+	kv := maelstromx.NewLinKV(node)
 
-func (s *server) handleSend(msg maelstrom.Message) error {
-	var body struct {
-		Key string          `json:"key"`
-		Msg json.RawMessage `json:"msg"`
+	s := &server{
+		node: node,
+		cfg:  cfg,
+		kv:   kv,
+		// With acks=all, messages are only read once every follower
+		// stored them.
+		liveness:  liveness{started: time.Now()},
+		partition: newPartition(cfg.chunkSize, cfg.retention.MaxMessages, cfg.replication.factor > 1 && cfg.replication.acksAll),
 	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+
+	maelstromx.Handle(node, "send", s.handleSend)
+	maelstromx.Handle(node, "send_batch", s.handleSendBatch)
+	maelstromx.Handle(node, "poll", s.handlePoll)
+	maelstromx.Handle(node, "commit_offsets", s.handleCommitOffsets)
+	maelstromx.Handle(node, "list_committed_offsets", s.handleListCommittedOffsets)
+	maelstromx.Handle(node, "list_groups", s.handleListGroups)
+	maelstromx.Handle(node, "delete_group", s.handleDeleteGroup)
+	maelstromx.HandleNoReply(node, "truncate", s.handleTruncate)
+	maelstromx.HandleNoReply(node, "watch", s.handleWatch)
+	maelstromx.HandleNoReply(node, "changed", s.handleChanged)
+
+	if s.replicated() {
+		node.Handle("init", s.startReplication)
+		maelstromx.HandleNoReply(node, "heartbeat", s.handleHeartbeat)
+		maelstromx.Handle(node, "fetch_log", s.handleFetchLog)
+		maelstromx.Handle(node, "replicate", s.handleReplicate)
 	}
 
-	offset, err := s.reserveOffset(context.Background(), body.Key)
-	if err != nil {
-		return err
+	return s
+}
+
+type server struct {
+	node      *maelstrom.Node
+	cfg       config
+	kv        *maelstromx.KV
+	partition *partition
+	notifier  kafka.Notifier
+	watchers  watchers
+
+	liveness liveness
+	matches  matches
+	// takeoverMu keeps a node from taking over the same key twice at once.
+	takeoverMu sync.Mutex
+}
+
+func (s *server) handleSend(msg maelstrom.Message, req kafka.SendRequest) (kafka.SendResponse, error) {
+	dest := s.leader(req.Key)
+	if dest == s.node.ID() {
+		offsets, err := s.appendLocal([]kafka.SendRequest{req})
+		if err != nil {
+			return kafka.SendResponse{}, err
+		}
+		return kafka.SendResponse{Offset: offsets[0]}, nil
 	}
 
-	msgCopy := json.RawMessage(append([]byte{}, body.Msg...))
-	if err := s.kv.Write(context.Background(), messageKey(body.Key, offset), msgCopy); err != nil {
-		return err
+	body := map[string]any{"type": "send", "key": req.Key, "msg": req.Msg}
+	if req.ProducerID != "" {
+		body["producer_id"] = req.ProducerID
+		body["seq"] = *req.Seq
 	}
 
-	response := map[string]any{
-		"type":   "send_ok",
-		"offset": offset,
+	var resp kafka.SendResponse
+	err := s.forward(dest, body, &resp)
+	if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+		// The leader rejected the send without appending it.
+		return kafka.SendResponse{}, err
+	}
+	if err != nil {
+		// The leader may have appended the message before the failure, so
+		// the outcome is indefinite.
+		return kafka.SendResponse{}, maelstromx.Errorf(maelstrom.Timeout, "forward send to %s: %v", dest, err)
 	}
 
-	return s.node.Reply(msg, response)
+	return resp, nil
 }
 
-func (s *server) handlePoll(msg maelstrom.Message) error {
-	var body struct {
-		Offsets map[string]int `json:"offsets"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+// handleSendBatch appends the messages of keys this node leads in one batch
+// and forwards the others to their leaders, one batch per leader.
+func (s *server) handleSendBatch(msg maelstrom.Message, req kafka.SendBatchRequest) (kafka.SendBatchResponse, error) {
+	// byLeader holds the indices of the messages of every leader.
+	byLeader := map[string][]int{}
+	for i, m := range req.Msgs {
+		dest := s.leader(m.Key)
+		byLeader[dest] = append(byLeader[dest], i)
 	}
 
-	result := make(map[string][][]any, len(body.Offsets))
+	offsets := make([]int, len(req.Msgs))
+	appended := false
+	for dest, indices := range byLeader {
+		msgs := make([]kafka.SendRequest, len(indices))
+		for j, i := range indices {
+			msgs[j] = req.Msgs[i]
+		}
 
-	for key, start := range body.Offsets {
-		next, err := s.readNextOffset(context.Background(), key)
+		got, err := s.sendBatchTo(dest, msgs)
 		if err != nil {
-			return err
+			if appended || maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+				// Part of the batch may be appended, so the outcome is
+				// indefinite.
+				return kafka.SendBatchResponse{}, maelstromx.Errorf(maelstrom.Timeout, "send batch to %s: %v", dest, err)
+			}
+			return kafka.SendBatchResponse{}, err
 		}
+		appended = true
 
-		if start < 0 {
-			start = 0
-		}
-		if start >= next {
-			result[key] = [][]any{}
-			continue
+		for j, i := range indices {
+			offsets[i] = got[j]
 		}
+	}
 
-		msgs := make([][]any, 0, next-start)
-		for offset := start; offset < next; offset++ {
-			val, err := s.kv.Read(context.Background(), messageKey(key, offset))
-			if err != nil {
-				if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-					break
-				}
-				return err
-			}
+	return kafka.SendBatchResponse{Offsets: offsets}, nil
+}
 
-			rawVal, err := json.Marshal(val)
-			if err != nil {
-				return err
-			}
+// sendBatchTo appends msgs, all led by dest, and returns their offsets.
+func (s *server) sendBatchTo(dest string, msgs []kafka.SendRequest) ([]int, error) {
+	if dest == s.node.ID() {
+		return s.appendLocal(msgs)
+	}
+
+	var resp kafka.SendBatchResponse
+	if err := s.forward(dest, map[string]any{"type": "send_batch", "msgs": msgs}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Offsets) != len(msgs) {
+		return nil, fmt.Errorf("got %d offsets for %d messages", len(resp.Offsets), len(msgs))
+	}
+	return resp.Offsets, nil
+}
 
-			msgs = append(msgs, []any{offset, json.RawMessage(rawVal)})
+// appendLocal appends msgs to keys this node leads, taking them over first
+// if needed, and returns their offsets once acks allows acknowledging them.
+func (s *server) appendLocal(msgs []kafka.SendRequest) ([]int, error) {
+	epochs := map[string]int{}
+	for _, m := range msgs {
+		if _, ok := epochs[m.Key]; ok {
+			continue
+		}
+		epoch, err := s.lead(m.Key)
+		if err != nil {
+			return nil, err
 		}
+		if err := s.checkFollowers(m.Key); err != nil {
+			return nil, err
+		}
+		epochs[m.Key] = epoch
+	}
 
-		result[key] = msgs
+	offsets, err := s.partition.appendBatch(msgs, epochs)
+	if err != nil {
+		return nil, err
 	}
 
-	response := map[string]any{
-		"type": "poll_ok",
-		"msgs": result,
+	// ends holds the offset after the last message of every key.
+	ends := map[string]int{}
+	for i, m := range msgs {
+		ends[m.Key] = max(ends[m.Key], offsets[i]+1)
+	}
+	for key, end := range ends {
+		if err := s.acknowledge(key, epochs[key], end); err != nil {
+			return nil, err
+		}
+		s.notifyChanged(key)
 	}
 
-	return s.node.Reply(msg, response)
+	return offsets, nil
 }
 
-func (s *server) handleCommitOffsets(msg maelstrom.Message) error {
-	var body struct {
-		Offsets map[string]int `json:"offsets"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
-	}
+func (s *server) handlePoll(msg maelstrom.Message, req kafka.PollRequest) (kafka.PollResponse, error) {
+	keys := slices.Collect(maps.Keys(req.Offsets))
+	return kafka.LongPoll(&s.notifier, keys, req.WaitMs, func() (kafka.PollResponse, bool, error) {
+		resp, err := s.poll(req.Offsets)
+		return resp, kafka.HasMessages(resp), err
+	}, func(wait time.Duration) {
+		s.watch(req.Offsets, wait)
+	})
+}
 
-	for key, offset := range body.Offsets {
-		if err := s.storeCommit(context.Background(), key, offset); err != nil {
-			return err
+// poll reads keys this node leads locally and polls the leaders of the
+// others.
+func (s *server) poll(offsets map[string]int) (kafka.PollResponse, error) {
+	byLeader := map[string]map[string]int{}
+	for key, start := range offsets {
+		dest := s.leader(key)
+		if byLeader[dest] == nil {
+			byLeader[dest] = map[string]int{}
 		}
+		byLeader[dest][key] = start
 	}
 
-	response := map[string]any{
-		"type": "commit_offsets_ok",
+	result := make(map[string][][]any, len(offsets))
+	truncated := map[string]int{}
+	for dest, offsets := range byLeader {
+		if dest == s.node.ID() {
+			for key, start := range offsets {
+				// A follower may miss acknowledged messages until it took
+				// over.
+				if _, err := s.lead(key); err != nil {
+					return kafka.PollResponse{}, err
+				}
+				msgs, first := s.partition.read(key, start, s.cfg.pollLimit)
+				result[key] = msgs
+				if start < first {
+					truncated[key] = first
+				}
+			}
+			continue
+		}
+
+		var resp kafka.PollResponse
+		if err := s.forward(dest, map[string]any{"type": "poll", "offsets": offsets}, &resp); err != nil {
+			return kafka.PollResponse{}, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "forward poll to %s: %v", dest, err)
+		}
+		maps.Copy(result, resp.Msgs)
+		maps.Copy(truncated, resp.Truncated)
 	}
 
-	return s.node.Reply(msg, response)
+	return kafka.PollResponse{Msgs: result, Truncated: truncated}, nil
 }
 
-func (s *server) handleListCommittedOffsets(msg maelstrom.Message) error {
-	var body struct {
-		Keys []string `json:"keys"`
-	}
-	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+func (s *server) handleCommitOffsets(msg maelstrom.Message, req kafka.CommitOffsetsRequest) (struct{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+
+	group := kafka.GroupName(req.Group)
+	generation, _, err := s.groupGeneration(ctx, group, true)
+	if err != nil {
+		return struct{}{}, err
 	}
 
-	offsets := make(map[string]int, len(body.Keys))
-	for _, key := range body.Keys {
-		offset, err := s.kv.ReadInt(context.Background(), commitKey(key))
-		if err != nil {
-			if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-				continue
-			}
-			return err
+	for key, offset := range req.Offsets {
+		if err := s.storeCommit(ctx, commitKey(group, generation, key), offset); err != nil {
+			return struct{}{}, err
 		}
-		offsets[key] = offset
 	}
 
-	response := map[string]any{
-		"type":    "list_committed_offsets_ok",
-		"offsets": offsets,
+	if s.cfg.retention.BelowCommitted {
+		// The offsets are committed already, so retention failing doesn't
+		// fail the request.
+		keys := slices.Collect(maps.Keys(req.Offsets))
+		if err := s.truncateCommitted(ctx, keys); err != nil {
+			log.Printf("truncate committed messages: %v", err)
+		}
 	}
 
-	return s.node.Reply(msg, response)
+	return struct{}{}, nil
 }
 
-func (s *server) reserveOffset(ctx context.Context, key string) (int, error) {
-	storageKey := nextOffsetKey(key)
+func (s *server) handleListCommittedOffsets(msg maelstrom.Message, req kafka.ListCommittedOffsetsRequest) (kafka.OffsetsMsg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
 
-	for {
-		current, err := s.kv.ReadInt(ctx, storageKey)
+	group := kafka.GroupName(req.Group)
+	generation, ok, err := s.groupGeneration(ctx, group, false)
+	if err != nil {
+		return kafka.OffsetsMsg{}, err
+	}
+
+	offsets := make(map[string]int, len(req.Keys))
+	if !ok {
+		return kafka.OffsetsMsg{Offsets: offsets}, nil
+	}
+
+	for _, key := range req.Keys {
+		offset, err := s.kv.ReadInt(ctx, commitKey(group, generation, key))
 		if err != nil {
 			if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-				current = 0
-			} else {
-				return 0, err
-			}
-		}
-
-		if err := s.kv.CompareAndSwap(ctx, storageKey, current, current+1, true); err != nil {
-			if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
 				continue
 			}
-			return 0, err
+			return kafka.OffsetsMsg{}, err
 		}
-
-		return current, nil
+		offsets[key] = offset
 	}
+
+	return kafka.OffsetsMsg{Offsets: offsets}, nil
 }
 
-func (s *server) readNextOffset(ctx context.Context, key string) (int, error) {
-	val, err := s.kv.ReadInt(ctx, nextOffsetKey(key))
+func (s *server) handleListGroups(msg maelstrom.Message, req struct{}) (kafka.ListGroupsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+
+	groups, err := s.listGroups(ctx)
 	if err != nil {
-		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
-			return 0, nil
-		}
-		return 0, err
+		return kafka.ListGroupsResponse{}, err
 	}
-	return val, nil
+
+	return kafka.ListGroupsResponse{Groups: groups}, nil
 }
 
-func (s *server) storeCommit(ctx context.Context, key string, offset int) error {
-	storageKey := commitKey(key)
+func (s *server) handleDeleteGroup(msg maelstrom.Message, req kafka.DeleteGroupRequest) (struct{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
 
+	return struct{}{}, s.deleteGroup(ctx, kafka.GroupName(req.Group))
+}
+
+// storeCommit raises the offset stored under storageKey to offset, retrying
+// conflicting CASes until ctx is done.
+func (s *server) storeCommit(ctx context.Context, storageKey string, offset int) error {
 	for {
 		current, err := s.kv.ReadInt(ctx, storageKey)
 		if err != nil {
@@ -225,14 +386,6 @@ func (s *server) storeCommit(ctx context.Context, key string, offset int) error
 	}
 }
 
-func nextOffsetKey(key string) string {
-	return fmt.Sprintf("log:%s:next", key)
-}
-
-func messageKey(key string, offset int) string {
-	return fmt.Sprintf("log:%s:%d", key, offset)
-}
-
-func commitKey(key string) string {
-	return fmt.Sprintf("commit:%s", key)
+func commitKey(group string, generation int, key string) string {
+	return fmt.Sprintf("commit:%s:%d:%s", group, generation, key)
 }
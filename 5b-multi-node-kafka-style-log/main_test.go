@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/kafkatest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func startNetwork(t *testing.T) *maelstromtest.Network {
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	return net
+}
+
+func TestKafka_concurrentClients(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var h checker.History
+	keys := []string{"a", "b", "c"}
+	nodeIDs := net.NodeIDs()
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			node := nodeIDs[i%len(nodeIDs)]
+			for j := range 10 {
+				send := checker.KafkaSend{Key: keys[j%len(keys)], Msg: i*100 + j}
+				checker.Record(&h, c.ID(), node, "send", send, func() (int, error) {
+					var resp kafka.SendResponse
+					err := c.RPCInto(ctx, node, map[string]any{"type": "send", "key": send.Key, "msg": send.Msg}, &resp)
+					return resp.Offset, err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := net.Client()
+	for _, node := range nodeIDs {
+		start := map[string]int{"a": 0, "b": 0, "c": 0}
+		msgs, err := checker.Record(&h, c.ID(), node, "poll", maps.Clone(start), func() (checker.KafkaMsgs, error) {
+			var resp struct {
+				Msgs checker.KafkaMsgs `json:"msgs"`
+			}
+			err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": start}, &resp)
+			return resp.Msgs, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := len(msgs["a"]) + len(msgs["b"]) + len(msgs["c"]); got != 40 {
+			t.Errorf("poll on %s returned %d messages, want 40", node, got)
+		}
+	}
+
+	if err := checker.CheckKafka(&h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKafka_sendsAvoidLinKV(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	kv := &recordingKV{KV: maelstromtest.NewKV(maelstrom.LinKV, rand.New(rand.NewSource(1)))}
+	net.AddService(maelstrom.LinKV, kv)
+	net.AddNodes(3, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i, key := range keys {
+		// Every key is sent through every node, owner or not.
+		for j, node := range net.NodeIDs() {
+			var resp kafka.SendResponse
+			if err := c.RPCInto(ctx, node, map[string]any{"type": "send", "key": key, "msg": i*10 + j}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Offset != j {
+				t.Errorf("send to %s via %s got offset %d, want %d", key, node, resp.Offset, j)
+			}
+		}
+	}
+
+	for _, node := range net.NodeIDs() {
+		var resp struct {
+			Msgs map[string][][2]int `json:"msgs"`
+		}
+		offsets := map[string]int{"a": 0, "b": 1, "c": 2, "d": 3, "e": 0}
+		if err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": offsets}, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, key := range keys {
+			if got, want := len(resp.Msgs[key]), 3-offsets[key]; got != want {
+				t.Errorf("poll of %s on %s returned %d messages, want %d", key, node, got, want)
+				continue
+			}
+			for _, m := range resp.Msgs[key] {
+				if m[1] != i*10+m[0] {
+					t.Errorf("poll of %s on %s returned %v at offset %d", key, node, m[1], m[0])
+				}
+			}
+		}
+	}
+
+	if got := kv.requests.Load(); got != 0 {
+		t.Errorf("sends and polls made %d lin-kv requests, want none", got)
+	}
+}
+
+// recordingKV counts the requests it serves.
+type recordingKV struct {
+	*maelstromtest.KV
+	requests atomic.Int64
+}
+
+func (kv *recordingKV) Handle(msg maelstrom.Message) any {
+	kv.requests.Add(1)
+	return kv.KV.Handle(msg)
+}
+
+func TestKafka_pollLimit(t *testing.T) {
+	cfg := defaultConfig
+	cfg.pollLimit = 30
+	cfg.chunkSize = 100
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for i := range 250 {
+		if _, err := c.RPC(ctx, "n0", map[string]any{"type": "send", "key": "a", "msg": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		start, first, count int
+	}{
+		{start: 0, first: 0, count: 30},
+		{start: 95, first: 95, count: 30},
+		{start: 240, first: 240, count: 10},
+		{start: 250, count: 0},
+		{start: -5, first: 0, count: 30},
+	} {
+		for _, node := range net.NodeIDs() {
+			var resp struct {
+				Msgs map[string][][2]int `json:"msgs"`
+			}
+			if err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": map[string]int{"a": tt.start}}, &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			msgs := resp.Msgs["a"]
+			if len(msgs) != tt.count {
+				t.Errorf("poll from %d on %s returned %d messages, want %d", tt.start, node, len(msgs), tt.count)
+				continue
+			}
+			for i, m := range msgs {
+				if want := tt.first + i; m != [2]int{want, want} {
+					t.Errorf("poll from %d on %s returned %v, want [%d %d]", tt.start, node, m, want, want)
+				}
+			}
+		}
+	}
+}
+
+func TestKafka_commitOffsets(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+
+	commits := []map[string]int{{"a": 2}, {"a": 1, "b": 4}}
+	for i, offsets := range commits {
+		if _, err := c.RPC(ctx, net.NodeIDs()[i], map[string]any{"type": "commit_offsets", "offsets": offsets}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, node := range net.NodeIDs() {
+		var resp kafka.OffsetsMsg
+		if err := c.RPCInto(ctx, node, map[string]any{"type": "list_committed_offsets", "keys": []string{"a", "b", "c"}}, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]int{"a": 2, "b": 4}
+		if !reflect.DeepEqual(resp.Offsets, want) {
+			t.Errorf("%s list_committed_offsets = %v, want %v", node, resp.Offsets, want)
+		}
+	}
+}
+
+func TestKafka_consumerGroups(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	kafkatest.ConsumerGroups(ctx, t, c, "n0")
+
+	// Groups live in lin-kv, so every node sees the same ones.
+	var resp kafka.ListGroupsResponse
+	if err := c.RPCInto(ctx, "n1", map[string]any{"type": "list_groups"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"audit", "billing", "default"}; !reflect.DeepEqual(resp.Groups, want) {
+		t.Errorf("n1 list_groups = %v, want %v", resp.Groups, want)
+	}
+}
+
+func TestKafka_groupsTimeout(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddService(maelstrom.LinKV, silentKV{})
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node, defaultConfig) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// lin-kv never answers, so every group request gives up once kvTimeout
+	// passed.
+	c := net.Client()
+	for _, body := range []map[string]any{
+		{"type": "commit_offsets", "offsets": map[string]int{"a": 1}},
+		{"type": "list_committed_offsets", "keys": []string{"a"}},
+		{"type": "list_groups"},
+		{"type": "delete_group", "group": "audit"},
+	} {
+		start := time.Now()
+		_, err := c.RPC(ctx, "n0", body)
+		if code := maelstrom.ErrorCode(err); code != maelstrom.Timeout {
+			t.Errorf("%s: got error %v, want Timeout", body["type"], err)
+		}
+		if took := time.Since(start); took > 2*kvTimeout {
+			t.Errorf("%s took %v, want about %v", body["type"], took, kvTimeout)
+		}
+	}
+}
+
+// silentKV never answers.
+type silentKV struct{}
+
+func (silentKV) Handle(msg maelstrom.Message) any { return nil }
+
+func TestKafka_retention(t *testing.T) {
+	cfg := defaultConfig
+	cfg.chunkSize = 4
+	cfg.retention = kafka.Retention{MaxMessages: 10, BelowCommitted: true}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node, cfg) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	key := "a"
+	// Poll through the node that doesn't own the key, so the truncated
+	// offsets travel back through a forwarded poll.
+	node := net.NodeIDs()[0]
+	if owner(key, net.NodeIDs()) == node {
+		node = net.NodeIDs()[1]
+	}
+
+	for i := range 15 {
+		if _, err := c.RPC(ctx, node, map[string]any{"type": "send", "key": key, "msg": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	poll := func() (first int, truncated map[string]int) {
+		t.Helper()
+
+		var resp struct {
+			Msgs      map[string][][2]int `json:"msgs"`
+			Truncated map[string]int      `json:"truncated"`
+		}
+		if err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": map[string]int{key: 0}}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Msgs[key]) == 0 {
+			t.Fatalf("poll from 0 returned no messages")
+		}
+		return resp.Msgs[key][0][0], resp.Truncated
+	}
+
+	// maxMessages keeps the newest 10 of the 15 messages.
+	if first, truncated := poll(); first != 5 || !maps.Equal(truncated, map[string]int{key: 5}) {
+		t.Errorf("poll from 0 started at %d with truncated %v, want 5 and map[a:5]", first, truncated)
+	}
+
+	commit := func(group string, offset int) {
+		t.Helper()
+
+		body := map[string]any{"type": "commit_offsets", "group": group, "offsets": map[string]int{key: offset}}
+		if _, err := c.RPC(ctx, node, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A group only holds back truncation once it exists, so the lower
+	// commit goes first.
+	commit("two", 9)
+	commit("one", 12)
+
+	// The owner truncates asynchronously, up to the lowest commit.
+	maelstromtest.Eventually(t, 2*time.Second, func() error {
+		if first, truncated := poll(); first != 9 || !maps.Equal(truncated, map[string]int{key: 9}) {
+			return fmt.Errorf("poll from 0 started at %d with truncated %v, want 9 and map[a:9]", first, truncated)
+		}
+		return nil
+	})
+
+	// Polls from retained offsets aren't marked as truncated.
+	var resp kafka.PollResponse
+	if err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": map[string]int{key: 11}}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Truncated) != 0 {
+		t.Errorf("poll from 11 returned truncated %v, want none", resp.Truncated)
+	}
+}
+
+func TestKafka_longPoll(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	// The poll is parked on the owner of the key and on the other node, so
+	// both local appends and changes on the owner wake it up.
+	for i, node := range net.NodeIDs() {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			if _, err := c.RPC(ctx, node, map[string]any{"type": "send", "key": "a", "msg": i}); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		var resp struct {
+			Msgs map[string][][2]int `json:"msgs"`
+		}
+		start := time.Now()
+		body := map[string]any{"type": "poll", "offsets": map[string]int{"a": i, "b": 0}, "wait_ms": 3000}
+		if err := net.Client().RPCInto(ctx, node, body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+
+		if want := [][2]int{{i, i}}; !reflect.DeepEqual(resp.Msgs["a"], want) {
+			t.Errorf("parked poll on %s returned %v, want a: %v", node, resp.Msgs, want)
+		}
+		if elapsed < 100*time.Millisecond || elapsed > time.Second {
+			t.Errorf("parked poll on %s returned after %v, want after the send", node, elapsed)
+		}
+	}
+
+	// Without messages the poll is answered when wait_ms runs out.
+	for _, node := range net.NodeIDs() {
+		var resp kafka.PollResponse
+		start := time.Now()
+		body := map[string]any{"type": "poll", "offsets": map[string]int{"a": 2, "b": 0}, "wait_ms": 100}
+		if err := c.RPCInto(ctx, node, body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); kafka.HasMessages(resp) || elapsed < 100*time.Millisecond {
+			t.Errorf("poll on %s returned %v after %v, want no messages after 100ms", node, resp.Msgs, elapsed)
+		}
+	}
+}
+
+func TestKafka_idempotentSend(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Retries go through both the owner of a key and the other node, which
+	// forwards them.
+	kafkatest.IdempotentSend(ctx, t, net.Client(), net.NodeIDs())
+}
+
+func TestKafka_sendBatch(t *testing.T) {
+	net := startNetwork(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kafkatest.SendBatch(ctx, t, net.Client(), net.NodeIDs())
+}
+
+// startReplicated starts a network of nodes replicating their keys, and
+// returns it with the setup restarted nodes need.
+func startReplicated(t *testing.T, nodes int, repl replicationConfig) (*maelstromtest.Network, func(*maelstrom.Node)) {
+	cfg := defaultConfig
+	cfg.pollLimit = 10000
+	cfg.replication = repl
+	setup := func(node *maelstrom.Node) { newServer(node, cfg) }
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(nodes, setup)
+	net.Start()
+
+	return net, setup
+}
+
+func TestKafka_replicatedSends(t *testing.T) {
+	for _, acksAll := range []bool{false, true} {
+		t.Run(fmt.Sprintf("acksAll=%v", acksAll), func(t *testing.T) {
+			repl := replicationConfig{factor: 2, acksAll: acksAll}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// Leaders take over their keys on the first send, then behave
+			// as without replication.
+			net, _ := startReplicated(t, 3, repl)
+			kafkatest.IdempotentSend(ctx, t, net.Client(), net.NodeIDs())
+			net, _ = startReplicated(t, 3, repl)
+			kafkatest.SendBatch(ctx, t, net.Client(), net.NodeIDs())
+		})
+	}
+}
+
+func TestKafka_replicatedFailover(t *testing.T) {
+	net, setup := startReplicated(t, 3, replicationConfig{factor: 3, acksAll: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var h checker.History
+	keys := []string{"a", "b", "c"}
+	nodeIDs := net.NodeIDs()
+	leader := owner("a", nodeIDs)
+
+	var isolated atomic.Bool
+	var failedOver atomic.Int64
+	// acked maps the offsets of acknowledged sends to their messages.
+	var mu sync.Mutex
+	acked := map[string]map[int]int{"a": {}, "b": {}, "c": {}}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				node := nodeIDs[(i+j)%len(nodeIDs)]
+				send := checker.KafkaSend{Key: keys[j%len(keys)], Msg: i*10000 + j}
+				// Sends to an isolated or killed node are lost, so they time
+				// out and aren't acknowledged.
+				sendCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+				offset, err := checker.Record(&h, c.ID(), node, "send", send, func() (int, error) {
+					var resp kafka.SendResponse
+					err := c.RPCInto(sendCtx, node, map[string]any{"type": "send", "key": send.Key, "msg": send.Msg}, &resp)
+					return resp.Offset, err
+				})
+				cancel()
+				if err != nil {
+					continue
+				}
+
+				if isolated.Load() && send.Key == "a" && node != leader {
+					failedOver.Add(1)
+				}
+				mu.Lock()
+				acked[send.Key][offset] = send.Msg
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// The leader of a is cut off long enough for the others to take over,
+	// then comes back, then loses its log.
+	time.Sleep(300 * time.Millisecond)
+	isolated.Store(true)
+	net.Isolate(leader)
+	time.Sleep(time.Second)
+	isolated.Store(false)
+	net.Heal()
+	time.Sleep(500 * time.Millisecond)
+	net.Restart(leader, setup)
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if failedOver.Load() == 0 {
+		t.Error("no sends to a were acknowledged while its leader was isolated")
+	}
+
+	c := net.Client()
+	for _, node := range nodeIDs {
+		start := map[string]int{"a": 0, "b": 0, "c": 0}
+		msgs, err := checker.Record(&h, c.ID(), node, "poll", maps.Clone(start), func() (checker.KafkaMsgs, error) {
+			var resp struct {
+				Msgs checker.KafkaMsgs `json:"msgs"`
+			}
+			err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": start}, &resp)
+			return resp.Msgs, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for key, want := range acked {
+			got := map[int]int{}
+			for _, m := range msgs[key] {
+				got[m[0]] = m[1]
+			}
+			for offset, msg := range want {
+				if m, ok := got[offset]; !ok || m != msg {
+					t.Errorf("poll on %s returned %v at acknowledged offset %d of %s, want %d", node, msgs[key], offset, key, msg)
+				}
+			}
+		}
+	}
+
+	if err := checker.CheckKafka(&h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKafka_replicatedCatchUp(t *testing.T) {
+	net, setup := startReplicated(t, 2, replicationConfig{factor: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	nodeIDs := net.NodeIDs()
+	leader := owner("a", nodeIDs)
+	follower := nodeIDs[0]
+	if follower == leader {
+		follower = nodeIDs[1]
+	}
+
+	c := net.Client()
+	send := func(msg int) {
+		t.Helper()
+		if _, err := c.RPC(ctx, leader, map[string]any{"type": "send", "key": "a", "msg": msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With acks=1 the leader acknowledges sends its follower can't get yet.
+	send(0)
+	net.Isolate(follower)
+	for i := 1; i < 5; i++ {
+		send(i)
+	}
+	net.Heal()
+
+	// Once the follower caught up, the log survives losing the leader's.
+	time.Sleep(500 * time.Millisecond)
+	net.Restart(leader, setup)
+
+	var resp struct {
+		Msgs map[string][][2]int `json:"msgs"`
+	}
+	if err := c.RPCInto(ctx, leader, map[string]any{"type": "poll", "offsets": map[string]int{"a": 0}}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]int{{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 4}}; !reflect.DeepEqual(resp.Msgs["a"], want) {
+		t.Errorf("poll after restarting the leader = %v, want %v", resp.Msgs["a"], want)
+	}
+}
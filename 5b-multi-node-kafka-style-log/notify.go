@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// watchers tracks the nodes with polls parked on keys this node leads, with
+// the time their polls give up.
+type watchers struct {
+	mu    sync.Mutex
+	byKey map[string]map[string]time.Time
+}
+
+// watchMsg asks the owner of the keys to send a changedMsg once one of them
+// has a message at or after its offset.
+type watchMsg struct {
+	Offsets map[string]int `json:"offsets"`
+	WaitMs  int            `json:"wait_ms"`
+}
+
+type changedMsg struct {
+	Keys []string `json:"keys"`
+}
+
+// watch asks the leaders of the keys polled from offsets to notify this node
+// of new messages for the next wait. Keys led by this node are notified by
+// their appends.
+func (s *server) watch(offsets map[string]int, wait time.Duration) {
+	byOwner := map[string]map[string]int{}
+	for key, offset := range offsets {
+		dest := s.leader(key)
+		if dest == s.node.ID() {
+			continue
+		}
+		if byOwner[dest] == nil {
+			byOwner[dest] = map[string]int{}
+		}
+		byOwner[dest][key] = offset
+	}
+
+	for dest, offsets := range byOwner {
+		body := map[string]any{"type": "watch", "offsets": offsets, "wait_ms": wait.Milliseconds()}
+		if err := s.node.Send(dest, body); err != nil {
+			log.Printf("watch on %s failed: %v", dest, err)
+		}
+	}
+}
+
+// handleWatch registers the sender for changes of the keys it polls. Keys
+// that got messages since the sender polled them are reported right away.
+func (s *server) handleWatch(msg maelstrom.Message, req watchMsg) error {
+	now := time.Now()
+	deadline := now.Add(min(time.Duration(req.WaitMs)*time.Millisecond, kafka.MaxPollWait))
+
+	// Holding the lock while checking the offsets keeps appends from
+	// notifying the watchers in between.
+	s.watchers.mu.Lock()
+	defer s.watchers.mu.Unlock()
+
+	if s.watchers.byKey == nil {
+		s.watchers.byKey = make(map[string]map[string]time.Time)
+	}
+
+	var changed []string
+	for key, offset := range req.Offsets {
+		if s.partition.end(key) > offset {
+			changed = append(changed, key)
+			continue
+		}
+
+		nodes, ok := s.watchers.byKey[key]
+		if !ok {
+			nodes = make(map[string]time.Time)
+			s.watchers.byKey[key] = nodes
+		}
+		maps.DeleteFunc(nodes, func(_ string, until time.Time) bool { return until.Before(now) })
+		nodes[msg.Src] = deadline
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+	return s.node.Send(msg.Src, map[string]any{"type": "changed", "keys": changed})
+}
+
+// notifyChanged wakes up the polls parked on key, on this node and on the
+// nodes watching it.
+func (s *server) notifyChanged(key string) {
+	s.notifier.Notify(key)
+
+	s.watchers.mu.Lock()
+	nodes := s.watchers.byKey[key]
+	delete(s.watchers.byKey, key)
+	s.watchers.mu.Unlock()
+
+	now := time.Now()
+	for dest, until := range nodes {
+		if until.Before(now) {
+			continue
+		}
+		// A lost notification only leaves the poll waiting until it times
+		// out.
+		if err := s.node.Send(dest, map[string]any{"type": "changed", "keys": []string{key}}); err != nil {
+			log.Printf("notify %s of %s failed: %v", dest, key, err)
+		}
+	}
+}
+
+func (s *server) handleChanged(msg maelstrom.Message, req changedMsg) error {
+	for _, key := range req.Keys {
+		s.notifier.Notify(key)
+	}
+	return nil
+}
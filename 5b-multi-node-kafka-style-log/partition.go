@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// forwardTimeout bounds a request forwarded to the owner of a key.
+const forwardTimeout = 1000 * time.Millisecond
+
+// owner returns the node that assigns offsets to key and stores its log.
+func owner(key string, nodeIDs []string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return nodeIDs[h.Sum32()%uint32(len(nodeIDs))]
+}
+
+// partition holds the logs of the keys this node leads or follows. Only the
+// leader appends to a log, so offsets are assigned without coordination.
+type partition struct {
+	chunkSize   int
+	maxMessages int
+	// holdUncommitted hides appended messages from polls until the leader
+	// commits them.
+	holdUncommitted bool
+
+	mu        sync.Mutex
+	logs      map[string]*keyLog
+	sequences kafka.Sequences
+}
+
+// keyLog stores the messages of a key in chunks of chunkSize consecutive
+// offsets, so appends never copy the whole log, a poll only touches the
+// chunks it returns and truncation drops whole chunks.
+type keyLog struct {
+	chunks [][]entry
+	// dropped counts the chunks removed from the front of chunks.
+	dropped int
+	// first is the lowest retained offset.
+	first int
+	next  int
+	// committed is the offset polls read up to.
+	committed int
+	// epoch is the highest leader epoch seen for the key. It stays 0
+	// without replication.
+	epoch int
+	// leading is set while this node leads the key in epoch. An epoch
+	// this node would lead in may be one of its previous incarnation.
+	leading bool
+}
+
+// entry is a message with the epoch of the leader that appended it and the
+// producer that sent it, so followers can deduplicate retried sends once
+// they lead.
+type entry struct {
+	Epoch      int             `json:"epoch"`
+	Msg        json.RawMessage `json:"msg"`
+	ProducerID string          `json:"producer_id,omitempty"`
+	Seq        int             `json:"seq,omitempty"`
+}
+
+func newPartition(chunkSize, maxMessages int, holdUncommitted bool) *partition {
+	return &partition{
+		chunkSize:       chunkSize,
+		maxMessages:     maxMessages,
+		holdUncommitted: holdUncommitted,
+		logs:            map[string]*keyLog{},
+	}
+}
+
+// appendBatch appends all messages of reqs under one lock, so the new
+// messages of each key get consecutive offsets, and returns their offsets.
+// epochs holds the epoch this node leads each key in, if replicated.
+func (p *partition) appendBatch(reqs []kafka.SendRequest, epochs map[string]int) ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, req := range reqs {
+		if err := p.checkEpochLocked(req.Key, epochs[req.Key]); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.sequences.CheckBatch(reqs); err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int, len(reqs))
+	for i, req := range reqs {
+		offset, err := p.appendLocked(req, epochs[req.Key])
+		if err != nil {
+			return nil, err
+		}
+		offsets[i] = offset
+	}
+
+	return offsets, nil
+}
+
+// appendLocked appends the message of req. p.mu must be held.
+func (p *partition) appendLocked(req kafka.SendRequest, epoch int) (int, error) {
+	if err := p.checkEpochLocked(req.Key, epoch); err != nil {
+		return 0, err
+	}
+
+	if req.ProducerID != "" {
+		offset, ok, err := p.sequences.Lookup(req.ProducerID, req.Key, *req.Seq)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+
+	e := entry{Epoch: epoch, Msg: json.RawMessage(append([]byte{}, req.Msg...)), ProducerID: req.ProducerID}
+	if req.Seq != nil {
+		e.Seq = *req.Seq
+	}
+
+	l := p.logLocked(req.Key)
+	offset := p.appendEntryLocked(req.Key, l, e)
+	if !p.holdUncommitted {
+		l.committed = l.next
+	}
+	return offset, nil
+}
+
+// checkEpochLocked fails if a leader of a later epoch than the one this
+// node appends in took over key. p.mu must be held.
+func (p *partition) checkEpochLocked(key string, epoch int) error {
+	if l, ok := p.logs[key]; ok && l.epoch != epoch {
+		return maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "epoch %d of %q is over, it's at %d", epoch, key, l.epoch)
+	}
+	return nil
+}
+
+// logLocked returns the log of key, creating it if needed. p.mu must be
+// held.
+func (p *partition) logLocked(key string) *keyLog {
+	l, ok := p.logs[key]
+	if !ok {
+		l = &keyLog{}
+		p.logs[key] = l
+	}
+	return l
+}
+
+// appendEntryLocked appends e to l, the log of key, and returns its offset.
+// p.mu must be held.
+func (p *partition) appendEntryLocked(key string, l *keyLog, e entry) int {
+	if l.next%p.chunkSize == 0 || len(l.chunks) == 0 {
+		// A log starting in the middle of a chunk leaves the offsets before
+		// it empty.
+		l.chunks = append(l.chunks, make([]entry, l.next%p.chunkSize, p.chunkSize))
+		if len(l.chunks) == 1 {
+			l.dropped = l.next / p.chunkSize
+		}
+	}
+	last := len(l.chunks) - 1
+	l.chunks[last] = append(l.chunks[last], e)
+
+	offset := l.next
+	l.next++
+	if e.ProducerID != "" {
+		p.sequences.Record(e.ProducerID, key, e.Seq, offset)
+	}
+
+	if p.maxMessages > 0 {
+		p.truncateLocked(l, l.next-p.maxMessages)
+	}
+	return offset
+}
+
+// entryLocked returns the entry of l at offset, which must be retained.
+// p.mu must be held.
+func (p *partition) entryLocked(l *keyLog, offset int) entry {
+	return l.chunks[offset/p.chunkSize-l.dropped][offset%p.chunkSize]
+}
+
+// read returns up to limit committed messages of key from offset start on.
+// If start was truncated, the messages start at the first retained offset,
+// which is returned as first.
+func (p *partition) read(key string, start, limit int) (msgs [][]any, first int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msgs = [][]any{}
+
+	l, ok := p.logs[key]
+	if !ok {
+		return msgs, 0
+	}
+
+	for offset := max(start, l.first); offset < l.committed && len(msgs) < limit; offset++ {
+		msgs = append(msgs, []any{offset, p.entryLocked(l, offset).Msg})
+	}
+	return msgs, l.first
+}
+
+// end returns the offset after the last message of key polls can read.
+func (p *partition) end(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.logs[key]; ok {
+		return l.committed
+	}
+	return 0
+}
+
+// commit makes the messages of key below offset readable.
+func (p *partition) commit(key string, offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.logs[key]; ok {
+		l.committed = max(l.committed, min(offset, l.next))
+	}
+}
+
+// truncate drops the messages of key below offset.
+func (p *partition) truncate(key string, offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.logs[key]; ok {
+		p.truncateLocked(l, offset)
+	}
+}
+
+// truncateLocked drops the messages of l below offset, never past the end
+// of the log. p.mu must be held.
+func (p *partition) truncateLocked(l *keyLog, offset int) {
+	offset = min(offset, l.next)
+	if offset <= l.first {
+		return
+	}
+	l.first = offset
+
+	for len(l.chunks) > 0 && (l.dropped+1)*p.chunkSize <= l.first {
+		l.chunks[0] = nil
+		l.chunks = l.chunks[1:]
+		l.dropped++
+	}
+}
+
+// dropFromLocked drops the messages of l, the log of key, from offset on,
+// which a leader replaced. p.mu must be held.
+func (p *partition) dropFromLocked(key string, l *keyLog, offset int) {
+	if offset >= l.next {
+		return
+	}
+	if offset <= l.first {
+		*l = keyLog{first: offset, next: offset, committed: offset, epoch: l.epoch}
+	} else {
+		n := offset - l.dropped*p.chunkSize
+		l.chunks = l.chunks[:(n+p.chunkSize-1)/p.chunkSize]
+		if last := len(l.chunks) - 1; n%p.chunkSize != 0 {
+			clear(l.chunks[last][n%p.chunkSize:])
+			l.chunks[last] = l.chunks[last][:n%p.chunkSize]
+		}
+		l.next = offset
+		l.committed = min(l.committed, offset)
+	}
+	p.sequences.Forget(key, offset)
+}
+
+// forward sends body to dest and decodes the reply into resp. Leaders
+// reply with Timeout errors when replication fails, which
+// maelstrom.Node.SyncRPC would pass off as a reply.
+func (s *server) forward(dest string, body, resp any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	msg, err := maelstromx.SyncRPC(ctx, s.node, dest, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(msg.Body, resp)
+}
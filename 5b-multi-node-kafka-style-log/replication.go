@@ -0,0 +1,711 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// replicationConfig makes every key stored on several nodes, so its log
+// survives the loss of its leader.
+type replicationConfig struct {
+	// factor is how many nodes store each key, its leader included.
+	// Replication is off at 1.
+	factor int
+	// acksAll makes the leader acknowledge a send once every follower it
+	// believes alive and at least a majority of the replicas stored it,
+	// instead of right after appending it.
+	acksAll bool
+}
+
+var defaultReplicationConfig = replicationConfig{factor: 1}
+
+// replicationFromEnv reads the replication settings from
+// KAFKA_REPLICATION_FACTOR and KAFKA_ACKS, which is "1" or "all".
+func replicationFromEnv() (replicationConfig, error) {
+	cfg := defaultReplicationConfig
+
+	if factor := os.Getenv("KAFKA_REPLICATION_FACTOR"); factor != "" {
+		n, err := strconv.Atoi(factor)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid KAFKA_REPLICATION_FACTOR %q", factor)
+		}
+		cfg.factor = n
+	}
+
+	switch acks := os.Getenv("KAFKA_ACKS"); acks {
+	case "", "1":
+	case "all":
+		cfg.acksAll = true
+	default:
+		return cfg, fmt.Errorf("invalid KAFKA_ACKS %q", acks)
+	}
+
+	return cfg, nil
+}
+
+const (
+	// heartbeatInterval is how often a node tells every peer it's alive.
+	heartbeatInterval = 100 * time.Millisecond
+	// failureTimeout is how long a peer can stay silent before it's
+	// believed down and its keys are led by the next replica.
+	failureTimeout = 500 * time.Millisecond
+	// catchUpInterval is how often leaders send followers the messages
+	// they miss.
+	catchUpInterval = 100 * time.Millisecond
+	// maxReplicateEntries caps the messages of a replicate message.
+	maxReplicateEntries = 100
+)
+
+// replicas returns the nodes storing key, starting at its owner and in the
+// order they take over leading it.
+func replicas(key string, nodeIDs []string, factor int) []string {
+	first := slices.Index(nodeIDs, owner(key, nodeIDs))
+
+	ids := make([]string, min(factor, len(nodeIDs)))
+	for i := range ids {
+		ids[i] = nodeIDs[(first+i)%len(nodeIDs)]
+	}
+	return ids
+}
+
+func (s *server) replicated() bool {
+	return s.cfg.replication.factor > 1
+}
+
+// leader returns the node appending to key: the first of its replicas this
+// node believes alive. A replica only forwards to replicas before it, so
+// forwarded sends never loop even when nodes disagree on who's alive.
+func (s *server) leader(key string) string {
+	ids := replicas(key, s.node.NodeIDs(), s.cfg.replication.factor)
+	for _, id := range ids {
+		if s.alive(id) {
+			return id
+		}
+	}
+	return ids[0]
+}
+
+// followers returns the other replicas of key this node believes alive.
+func (s *server) followers(key string) []string {
+	var ids []string
+	for _, id := range replicas(key, s.node.NodeIDs(), s.cfg.replication.factor) {
+		if id != s.node.ID() && s.alive(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// quorum returns how many replicas of key, this node included, must store a
+// send before acks=all acknowledges it, and must send their logs to a node
+// taking key over. Any two majorities share a replica, so a new leader
+// always sees every acknowledged send, even when nodes disagree on who's
+// alive. With acks=1 a leader only needs its own log.
+func (s *server) quorum(key string) int {
+	if !s.cfg.replication.acksAll {
+		return 1
+	}
+	return min(s.cfg.replication.factor, len(s.node.NodeIDs()))/2 + 1
+}
+
+// liveness tracks when every peer was last heard from. Peers count as
+// alive for failureTimeout after the node started, so a restarted node
+// taking over a key right away still fetches the logs of its replicas.
+type liveness struct {
+	mu       sync.Mutex
+	started  time.Time
+	lastSeen map[string]time.Time
+}
+
+func (s *server) alive(id string) bool {
+	if id == s.node.ID() || !s.replicated() {
+		return true
+	}
+
+	s.liveness.mu.Lock()
+	defer s.liveness.mu.Unlock()
+
+	last, ok := s.liveness.lastSeen[id]
+	if !ok {
+		last = s.liveness.started
+	}
+	return time.Since(last) < failureTimeout
+}
+
+func (s *server) seen(id string) {
+	s.liveness.mu.Lock()
+	defer s.liveness.mu.Unlock()
+
+	if s.liveness.lastSeen == nil {
+		s.liveness.lastSeen = make(map[string]time.Time)
+	}
+	s.liveness.lastSeen[id] = time.Now()
+}
+
+// startReplication starts the background loops once the node knows its
+// peers.
+func (s *server) startReplication(msg maelstrom.Message) error {
+	go s.heartbeatLoop()
+	go s.catchUpLoop()
+	return nil
+}
+
+func (s *server) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, id := range s.node.NodeIDs() {
+			if id == s.node.ID() {
+				continue
+			}
+			if err := s.node.Send(id, map[string]any{"type": "heartbeat"}); err != nil {
+				log.Printf("heartbeat to %s failed: %v", id, err)
+			}
+		}
+	}
+}
+
+func (s *server) handleHeartbeat(msg maelstrom.Message, req struct{}) error {
+	s.seen(msg.Src)
+	return nil
+}
+
+// nextEpoch returns the first epoch after epoch this node can lead in.
+// Epochs number the leaderships of a key, and a node only leads in epochs
+// congruent to its index modulo the cluster size, so no two nodes ever
+// lead a key in the same epoch.
+func (s *server) nextEpoch(epoch int) int {
+	n := len(s.node.NodeIDs())
+	return (epoch/n+1)*n + slices.Index(s.node.NodeIDs(), s.node.ID())
+}
+
+// lead makes sure this node leads key, taking it over if needed, and
+// returns the epoch it leads in. Without replication it always leads in
+// epoch 0.
+func (s *server) lead(key string) (int, error) {
+	if !s.replicated() {
+		return 0, nil
+	}
+	if epoch, ok := s.partition.leading(key); ok {
+		return epoch, nil
+	}
+
+	s.takeoverMu.Lock()
+	defer s.takeoverMu.Unlock()
+
+	if epoch, ok := s.partition.leading(key); ok {
+		return epoch, nil
+	}
+	return s.takeover(key)
+}
+
+// logSnapshot is the retained log of a key on one replica.
+type logSnapshot struct {
+	Epoch     int     `json:"epoch"`
+	First     int     `json:"first"`
+	Committed int     `json:"committed"`
+	Entries   []entry `json:"entries"`
+}
+
+func (snap logSnapshot) end() int {
+	return snap.First + len(snap.Entries)
+}
+
+// newer reports whether snap is more up to date than other: its last
+// message was appended in a later epoch, or it's longer.
+func (snap logSnapshot) newer(other logSnapshot) bool {
+	last := func(s logSnapshot) int {
+		if len(s.Entries) == 0 {
+			return 0
+		}
+		return s.Entries[len(s.Entries)-1].Epoch
+	}
+
+	if last(snap) != last(other) {
+		return last(snap) > last(other)
+	}
+	return snap.end() > other.end()
+}
+
+type fetchLogRequest struct {
+	Key   string `json:"key"`
+	Epoch int    `json:"epoch"`
+}
+
+// takeover starts leading key in a new epoch. The other live replicas are
+// fenced off the old leader and send their logs, and the new leader
+// continues the most up to date one, which holds every send acknowledged
+// with acks=all once a quorum of replicas answered.
+func (s *server) takeover(key string) (int, error) {
+	epoch := s.nextEpoch(s.partition.epoch(key))
+
+	best, replace := s.partition.snapshot(key), false
+	committed, answered := best.Committed, 1
+	for _, id := range s.followers(key) {
+		var snap logSnapshot
+		if err := s.forward(id, fetchLogRequest{Key: key, Epoch: epoch}.body(), &snap); err != nil {
+			log.Printf("fetch log of %q from %s: %v", key, id, err)
+			continue
+		}
+		if snap.Epoch > epoch {
+			s.partition.observeEpoch(key, snap.Epoch)
+			return 0, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "%q was taken over in epoch %d", key, snap.Epoch)
+		}
+		answered++
+		committed = max(committed, snap.Committed)
+		if snap.newer(best) {
+			best, replace = snap, true
+		}
+	}
+	if quorum := s.quorum(key); answered < quorum {
+		return 0, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "only %d of %d replicas of %q answered", answered, quorum, key)
+	}
+
+	end, ok := s.partition.adopt(key, epoch, best, replace, committed)
+	if !ok {
+		return 0, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "%q was taken over during epoch %d", key, epoch)
+	}
+	s.matches.reset(key)
+	log.Printf("leading %q in epoch %d", key, epoch)
+
+	// Make the sends the previous leader didn't commit readable, unless a
+	// later send does.
+	if err := s.acknowledge(key, epoch, end); err != nil {
+		log.Printf("commit %q in epoch %d: %v", key, epoch, err)
+	}
+	return epoch, nil
+}
+
+func (r fetchLogRequest) body() map[string]any {
+	return map[string]any{"type": "fetch_log", "key": r.Key, "epoch": r.Epoch}
+}
+
+// handleFetchLog fences the key off leaders before the requested epoch and
+// returns its log.
+func (s *server) handleFetchLog(msg maelstrom.Message, req fetchLogRequest) (logSnapshot, error) {
+	s.seen(msg.Src)
+	s.partition.observeEpoch(req.Key, req.Epoch)
+	return s.partition.snapshot(req.Key), nil
+}
+
+// replicateMsg carries the messages of a key from Offset on from its leader
+// to a follower.
+type replicateMsg struct {
+	Key   string `json:"key"`
+	Epoch int    `json:"epoch"`
+	// Offset is the offset of the first entry.
+	Offset int `json:"offset"`
+	// PrevEpoch is the epoch of the entry before Offset, which the follower
+	// must have for its log to match the leader's up to there. It's -1 if
+	// the leader doesn't retain the entry.
+	PrevEpoch int `json:"prev_epoch"`
+	// First is the first offset the leader retains. A follower behind it
+	// skips the messages in between.
+	First     int     `json:"first"`
+	Committed int     `json:"committed"`
+	Entries   []entry `json:"entries"`
+}
+
+type replicateResponse struct {
+	OK    bool `json:"ok"`
+	Epoch int  `json:"epoch"`
+	// Next is where the follower's log stops matching the leader's, for a
+	// rejected message.
+	Next int `json:"next"`
+}
+
+func (s *server) handleReplicate(msg maelstrom.Message, req replicateMsg) (replicateResponse, error) {
+	s.seen(msg.Src)
+	return s.partition.replicate(req), nil
+}
+
+// errDeposed is returned when a node stopped leading a key while sending
+// its messages to followers.
+var errDeposed = errors.New("no longer the leader")
+
+// replicateTo sends dest the messages of key it misses, until it has all
+// messages below end.
+func (s *server) replicateTo(dest, key string, epoch, end int) error {
+	from, ok := s.matches.get(dest, key)
+	if !ok {
+		// Start at the end of the log. If the follower is behind, its
+		// reply says where to continue.
+		from = end
+	}
+
+	for {
+		req, ok := s.partition.replicationRequest(key, epoch, from)
+		if !ok {
+			return errDeposed
+		}
+
+		var resp replicateResponse
+		body := struct {
+			Type string `json:"type"`
+			replicateMsg
+		}{"replicate", req}
+		if err := s.forward(dest, body, &resp); err != nil {
+			return err
+		}
+
+		if resp.Epoch > epoch {
+			s.partition.observeEpoch(key, resp.Epoch)
+			return errDeposed
+		}
+
+		if !resp.OK {
+			if resp.Next == from {
+				return fmt.Errorf("%s is stuck at %d of %q", dest, from, key)
+			}
+			from = resp.Next
+			continue
+		}
+
+		from = req.Offset + len(req.Entries)
+		s.matches.set(dest, key, from)
+		if from >= end {
+			return nil
+		}
+	}
+}
+
+// acknowledge waits for the messages of key below end to be stored as
+// acks requires and makes them readable.
+func (s *server) acknowledge(key string, epoch, end int) error {
+	if !s.replicated() || !s.cfg.replication.acksAll {
+		return nil
+	}
+
+	followers := s.followers(key)
+	if quorum := s.quorum(key); len(followers)+1 < quorum {
+		return maelstromx.Errorf(maelstrom.Timeout, "only %d of %d replicas of %q are reachable", len(followers)+1, quorum, key)
+	}
+
+	errs := make([]error, len(followers))
+	var wg sync.WaitGroup
+	for i, id := range followers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.replicateTo(id, key, epoch, end)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return maelstromx.Errorf(maelstrom.Timeout, "replicate %q: %v", key, err)
+	}
+
+	s.partition.commit(key, end)
+	return nil
+}
+
+// checkFollowers fails a send that acks=all couldn't acknowledge, as too few
+// replicas of key are believed alive.
+func (s *server) checkFollowers(key string) error {
+	if !s.replicated() {
+		return nil
+	}
+	if n, quorum := len(s.followers(key))+1, s.quorum(key); n < quorum {
+		return maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "only %d of %d replicas of %q are reachable", n, quorum, key)
+	}
+	return nil
+}
+
+// catchUpLoop sends the followers of the keys this node leads the messages
+// they miss, such as after a partition or with acks=1.
+func (s *server) catchUpLoop() {
+	ticker := time.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		byFollower := map[string][]ledKey{}
+		for _, led := range s.partition.led() {
+			for _, id := range s.followers(led.key) {
+				if next, ok := s.matches.get(id, led.key); !ok || next < led.end {
+					byFollower[id] = append(byFollower[id], led)
+				}
+			}
+		}
+
+		for id, keys := range byFollower {
+			if !s.matches.start(id) {
+				// The previous round is still running.
+				continue
+			}
+			go func() {
+				defer s.matches.done(id)
+				for _, led := range keys {
+					if err := s.replicateTo(id, led.key, led.epoch, led.end); err != nil {
+						log.Printf("catch up %s on %q: %v", id, led.key, err)
+					}
+				}
+			}()
+		}
+	}
+}
+
+// matches tracks up to where the log of every follower matches the leader's
+// for every key.
+type matches struct {
+	mu       sync.Mutex
+	next     map[string]map[string]int
+	catching map[string]bool
+}
+
+func (m *matches) get(follower, key string) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next, ok := m.next[follower][key]
+	return next, ok
+}
+
+func (m *matches) set(follower, key string, next int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.next == nil {
+		m.next = make(map[string]map[string]int)
+	}
+	if m.next[follower] == nil {
+		m.next[follower] = make(map[string]int)
+	}
+	m.next[follower][key] = next
+}
+
+// reset forgets the followers of key, which a new epoch starts over with.
+func (m *matches) reset(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, keys := range m.next {
+		delete(keys, key)
+	}
+}
+
+// start marks a catch-up round with follower as running, unless it
+// already is.
+func (m *matches) start(follower string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.catching[follower] {
+		return false
+	}
+	if m.catching == nil {
+		m.catching = make(map[string]bool)
+	}
+	m.catching[follower] = true
+	return true
+}
+
+func (m *matches) done(follower string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.catching, follower)
+}
+
+// ledKey is a key this node leads, with the end of its log.
+type ledKey struct {
+	key        string
+	epoch, end int
+}
+
+// leading returns the epoch this node leads key in, if it does.
+func (p *partition) leading(key string) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.logs[key]; ok && l.leading {
+		return l.epoch, true
+	}
+	return 0, false
+}
+
+// epoch returns the highest epoch seen for key.
+func (p *partition) epoch(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.logs[key]; ok {
+		return l.epoch
+	}
+	return 0
+}
+
+// observeEpoch raises the epoch of key to epoch, so leaders of earlier
+// epochs can no longer append to it.
+func (p *partition) observeEpoch(key string, epoch int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.logLocked(key)
+	if epoch > l.epoch {
+		l.epoch, l.leading = epoch, false
+	}
+}
+
+// snapshot returns the retained log of key.
+func (p *partition) snapshot(key string) logSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.logs[key]
+	if !ok {
+		return logSnapshot{Entries: []entry{}}
+	}
+
+	snap := logSnapshot{Epoch: l.epoch, First: l.first, Committed: l.committed, Entries: make([]entry, 0, l.next-l.first)}
+	for offset := l.first; offset < l.next; offset++ {
+		snap.Entries = append(snap.Entries, p.entryLocked(l, offset))
+	}
+	return snap
+}
+
+// adopt makes this node the leader of key in epoch, continuing the log of
+// snap if replace is set and its own log otherwise, and returns the end of
+// the log. It fails if a later epoch took over meanwhile.
+//
+// Messages from committed on stay hidden until the new leader commits them,
+// and are restamped with epoch: a message counted as stored by a quorum in
+// an earlier epoch might still be replaced by a log ending in a later one.
+func (p *partition) adopt(key string, epoch int, snap logSnapshot, replace bool, committed int) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.logLocked(key)
+	if l.epoch > epoch {
+		return 0, false
+	}
+
+	if replace {
+		p.sequences.Forget(key, 0)
+		*l = keyLog{first: snap.First, next: snap.First}
+		for _, e := range snap.Entries {
+			p.appendEntryLocked(key, l, e)
+		}
+	}
+	l.epoch, l.leading = epoch, true
+
+	l.committed = l.next
+	if p.holdUncommitted {
+		l.committed = min(max(committed, l.first), l.next)
+	}
+	for offset := l.committed; offset < l.next; offset++ {
+		l.chunks[offset/p.chunkSize-l.dropped][offset%p.chunkSize].Epoch = epoch
+	}
+	return l.next, true
+}
+
+// led returns the keys this node leads.
+func (p *partition) led() []ledKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var keys []ledKey
+	for key, l := range p.logs {
+		if l.leading {
+			keys = append(keys, ledKey{key: key, epoch: l.epoch, end: l.next})
+		}
+	}
+	return keys
+}
+
+// replicationRequest returns the replicate message with the messages of key
+// from offset from on, or false if this node no longer leads key in epoch.
+func (p *partition) replicationRequest(key string, epoch, from int) (replicateMsg, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.logs[key]
+	if !ok || !l.leading || l.epoch != epoch {
+		return replicateMsg{}, false
+	}
+
+	from = min(max(from, l.first), l.next)
+	req := replicateMsg{
+		Key:       key,
+		Epoch:     epoch,
+		Offset:    from,
+		PrevEpoch: -1,
+		First:     l.first,
+		Committed: l.committed,
+		Entries:   []entry{},
+	}
+	if from > l.first {
+		req.PrevEpoch = p.entryLocked(l, from-1).Epoch
+	}
+	for offset := from; offset < l.next && len(req.Entries) < maxReplicateEntries; offset++ {
+		req.Entries = append(req.Entries, p.entryLocked(l, offset))
+	}
+	return req, true
+}
+
+// replicate applies a replicate message from the leader of a key. Entries
+// the follower already has are kept, so a delayed message never undoes a
+// later one, and entries of earlier epochs the leader replaced are dropped.
+func (p *partition) replicate(req replicateMsg) replicateResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.logLocked(req.Key)
+	if req.Epoch < l.epoch {
+		return replicateResponse{Epoch: l.epoch, Next: l.next}
+	}
+	if req.Epoch > l.epoch {
+		l.epoch, l.leading = req.Epoch, false
+	}
+
+	if req.Offset > l.next {
+		if req.Offset > req.First {
+			return replicateResponse{Epoch: l.epoch, Next: l.next}
+		}
+		// The leader no longer retains the messages in between.
+		p.sequences.Forget(req.Key, 0)
+		*l = keyLog{first: req.Offset, next: req.Offset, committed: req.Offset, epoch: l.epoch}
+	}
+
+	if prev := req.Offset - 1; req.PrevEpoch >= 0 && prev >= l.first && prev < l.next {
+		if conflict := p.entryLocked(l, prev).Epoch; conflict != req.PrevEpoch {
+			// Drop all entries of the conflicting epoch at once, rather
+			// than walking back one message per round trip.
+			from := prev
+			for from > l.first && p.entryLocked(l, from-1).Epoch == conflict {
+				from--
+			}
+			p.dropFromLocked(req.Key, l, from)
+			return replicateResponse{Epoch: l.epoch, Next: l.next}
+		}
+	}
+
+	for i, e := range req.Entries {
+		offset := req.Offset + i
+		if offset < l.first {
+			continue
+		}
+		if offset < l.next {
+			if p.entryLocked(l, offset).Epoch == e.Epoch {
+				continue
+			}
+			p.dropFromLocked(req.Key, l, offset)
+		}
+		p.appendEntryLocked(req.Key, l, e)
+	}
+
+	// Entries after the ones sent may still be replaced, so they aren't
+	// committed yet.
+	l.committed = max(l.committed, min(req.Committed, req.Offset+len(req.Entries), l.next))
+	return replicateResponse{OK: true, Epoch: l.epoch, Next: l.next}
+}
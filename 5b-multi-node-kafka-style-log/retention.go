@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type truncateMsg struct {
+	Offsets map[string]int `json:"offsets"`
+}
+
+// truncateCommitted tells the replicas of keys to drop messages committed by
+// every consumer group. Lost messages are fine, as the next commit of a key
+// sends its offset again.
+func (s *server) truncateCommitted(ctx context.Context, keys []string) error {
+	byNode := map[string]map[string]int{}
+	for _, key := range keys {
+		offset, ok, err := s.minCommitted(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		// Every replica drops the messages, so a follower taking over
+		// doesn't bring them back.
+		for _, dest := range replicas(key, s.node.NodeIDs(), s.cfg.replication.factor) {
+			if byNode[dest] == nil {
+				byNode[dest] = map[string]int{}
+			}
+			byNode[dest][key] = offset
+		}
+	}
+
+	for dest, offsets := range byNode {
+		if err := s.node.Send(dest, map[string]any{"type": "truncate", "offsets": offsets}); err != nil {
+			log.Printf("truncate on %s failed: %v", dest, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *server) handleTruncate(msg maelstrom.Message, req truncateMsg) error {
+	for key, offset := range req.Offsets {
+		s.partition.truncate(key, offset)
+	}
+	return nil
+}
+
+// minCommitted returns the lowest offset committed for key across consumer
+// groups. ok is false if some group didn't commit the key.
+func (s *server) minCommitted(ctx context.Context, key string) (offset int, ok bool, err error) {
+	index, err := s.readGroups(ctx)
+	if err != nil || len(index.Groups) == 0 {
+		return 0, false, err
+	}
+
+	first := true
+	for group, generation := range index.Groups {
+		groupOffset, err := s.kv.ReadInt(ctx, commitKey(group, generation, key))
+		if err != nil {
+			if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+				return 0, false, nil
+			}
+			return 0, false, err
+		}
+
+		if first || groupOffset < offset {
+			offset = groupOffset
+		}
+		first = false
+	}
+
+	return offset, true, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/txntest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestTxn(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+
+	var resp struct {
+		Txn json.RawMessage `json:"txn"`
+	}
+	txn := [][]any{{"r", 1, nil}, {"w", 1, 6}, {"r", 1, nil}, {"r", 2, nil}}
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "txn", "txn": txn}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[["r",1,null],["w",1,6],["r",1,6],["r",2,null]]`
+	if string(resp.Txn) != want {
+		t.Errorf("txn = %s, want %s", resp.Txn, want)
+	}
+
+	_, err := c.RPC(ctx, "n0", map[string]any{"type": "txn", "txn": [][]any{{"x", 1, nil}}})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Errorf("error code = %d, want %d", code, maelstrom.MalformedRequest)
+	}
+}
+
+func TestTxn_concurrentClients(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var h checker.History
+	txntest.RandomTxns(ctx, t, &h, net, net.NodeIDs(), 4, 25)
+
+	if err := checker.CheckTxn(&h); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/txntest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestTxn_replicatesWrites(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	txntest.ReplicatesWrites(ctx, t, net.Client(), net.NodeIDs())
+}
+
+func TestTxn_availableDuringPartition(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+	net.Isolate("n0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	txntest.ReadsOwnWrites(ctx, t, net.Client(), net.NodeIDs())
+}
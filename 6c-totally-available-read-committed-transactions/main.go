@@ -1,28 +1,34 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
 
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 func main() {
 	node := maelstrom.NewNode()
+	newServer(node)
 
-	s := server{
+	if err := node.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServer creates a server and registers its handlers on the node.
+func newServer(node *maelstrom.Node) *server {
+	s := &server{
 		node:  node,
 		store: map[float64]float64{},
 	}
 
-	node.Handle("txn", s.handleTxn)
-	node.Handle("replicate", s.handleReplicate)
+	maelstromx.Handle(node, "txn", s.handleTxn)
+	maelstromx.HandleNoReply(node, "replicate", s.handleReplicate)
 
-	if err := node.Run(); err != nil {
-		log.Fatal(err)
-	}
+	return s
 }
 
 type server struct {
@@ -32,20 +38,29 @@ type server struct {
 }
 
 type TxnMsg struct {
-	MsgID int            `json:"msg_id"`
-	Txn   []TxnOperation `json:"txn"`
+	Txn []TxnOperation `json:"txn"`
+}
+
+func (m TxnMsg) Validate() error {
+	for _, txn := range m.Txn {
+		switch txn.OperationType {
+		case "r":
+		case "w":
+			if txn.Value == nil {
+				return fmt.Errorf("missing value for write on key %v", txn.Key)
+			}
+		default:
+			return fmt.Errorf("invalid operation type '%s'", txn.OperationType)
+		}
+	}
+	return nil
 }
 
 type ReplicateMsg struct {
 	Txn []TxnOperation `json:"txn"`
 }
 
-func (s *server) handleTxn(msg maelstrom.Message) error {
-	var txnMsg TxnMsg
-	if err := json.Unmarshal(msg.Body, &txnMsg); err != nil {
-		return err
-	}
-
+func (s *server) handleTxn(msg maelstrom.Message, txnMsg TxnMsg) (TxnMsg, error) {
 	responseTxns := make([]TxnOperation, 0, len(txnMsg.Txn))
 	replicateTxns := make([]TxnOperation, 0, len(txnMsg.Txn))
 
@@ -63,17 +78,10 @@ func (s *server) handleTxn(msg maelstrom.Message) error {
 
 			responseTxns = append(responseTxns, responseTxn)
 		case "w":
-			if txn.Value == nil {
-				s.storeMu.Unlock()
-				return fmt.Errorf("missing value for write on key %v", txn.Key)
-			}
 			s.store[txn.Key] = *txn.Value
 
 			responseTxns = append(responseTxns, txn)
 			replicateTxns = append(replicateTxns, txn)
-		default:
-			s.storeMu.Unlock()
-			return fmt.Errorf("invalid operation type '%s'", txn.OperationType)
 		}
 
 	}
@@ -82,21 +90,10 @@ func (s *server) handleTxn(msg maelstrom.Message) error {
 
 	s.replicateWrites(replicateTxns)
 
-	response := map[string]any{
-		"type":        "txn_ok",
-		"in_reply_to": txnMsg.MsgID,
-		"txn":         responseTxns,
-	}
-
-	return s.node.Reply(msg, response)
+	return TxnMsg{Txn: responseTxns}, nil
 }
 
-func (s *server) handleReplicate(msg maelstrom.Message) error {
-	var replicateMsg ReplicateMsg
-	if err := json.Unmarshal(msg.Body, &replicateMsg); err != nil {
-		return err
-	}
-
+func (s *server) handleReplicate(msg maelstrom.Message, replicateMsg ReplicateMsg) error {
 	s.storeMu.Lock()
 	for _, txn := range replicateMsg.Txn {
 		if txn.OperationType != "w" || txn.Value == nil {
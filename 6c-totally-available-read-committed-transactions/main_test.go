@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/txntest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestTxn_replicatesWrites(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	txntest.ReplicatesWrites(ctx, t, net.Client(), net.NodeIDs())
+}
+
+func TestTxn_availableDuringPartition(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+	net.Isolate("n0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	txntest.ReadsOwnWrites(ctx, t, net.Client(), net.NodeIDs())
+}
+
+func TestTxn_readCommitted(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, func(node *maelstrom.Node) { newServer(node) })
+	net.Start()
+
+	// Replication racing concurrent transactions on other nodes must not
+	// expose G1 anomalies.
+	net.SetLatency(0, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var h checker.History
+	txntest.RandomTxns(ctx, t, &h, net, net.NodeIDs(), 6, 25)
+
+	if err := checker.CheckTxn(&h); err != nil {
+		t.Error(err)
+	}
+}
@@ -8,3 +8,5 @@ require (
 )
 
 require github.com/google/uuid v1.6.0
+
+require github.com/oklog/ulid/v2 v2.1.1
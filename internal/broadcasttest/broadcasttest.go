@@ -0,0 +1,138 @@
+// Package broadcasttest holds the client scenarios the fault-tolerant and
+// efficient broadcast solutions are both tested with.
+package broadcasttest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+)
+
+type readResponse struct {
+	Messages []float64 `json:"messages"`
+}
+
+// SetTopology sends topology to every node of net.
+func SetTopology(t testing.TB, net *maelstromtest.Network, topology map[string][]string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for _, id := range net.NodeIDs() {
+		if _, err := c.RPC(ctx, id, map[string]any{"type": "topology", "topology": topology}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Broadcast checks that messages broadcast to different nodes reach all of
+// them.
+func Broadcast(t testing.TB, net *maelstromtest.Network) {
+	t.Helper()
+
+	c := net.Client()
+
+	var h checker.History
+	want := broadcast(t, &h, c, net.NodeIDs(), 0, 20)
+	waitForValues(t, c, net.NodeIDs(), want)
+	check(t, &h, c, net.NodeIDs())
+}
+
+// Partition checks that messages broadcast while net is partitioned reach
+// every node once it heals.
+func Partition(t testing.TB, net *maelstromtest.Network) {
+	t.Helper()
+
+	c := net.Client()
+
+	net.SetLatency(time.Millisecond, 5*time.Millisecond)
+	net.Isolate("n2")
+	var h checker.History
+	want := broadcast(t, &h, c, net.NodeIDs(), 0, 10)
+
+	net.PartitionHalves()
+	want = append(want, broadcast(t, &h, c, net.NodeIDs(), 10, 20)...)
+
+	net.Heal()
+	waitForValues(t, c, net.NodeIDs(), want)
+	check(t, &h, c, net.NodeIDs())
+}
+
+// broadcast sends messages [from, to) round-robin to the nodes, recording
+// them in h, and returns them.
+func broadcast(t testing.TB, h *checker.History, c *maelstromtest.Client, nodeIDs []string, from, to int) []float64 {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var messages []float64
+	for i := from; i < to; i++ {
+		message := float64(i)
+		messages = append(messages, message)
+
+		node := nodeIDs[i%len(nodeIDs)]
+		_, err := checker.Record(h, c.ID(), node, "broadcast", i, func() (any, error) {
+			return c.RPC(ctx, node, map[string]any{"type": "broadcast", "message": message})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return messages
+}
+
+func waitForValues(t testing.TB, c *maelstromtest.Client, nodeIDs []string, want []float64) {
+	t.Helper()
+
+	maelstromtest.Eventually(t, 5*time.Second, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		for _, id := range nodeIDs {
+			var resp readResponse
+			if err := c.RPCInto(ctx, id, map[string]any{"type": "read"}, &resp); err != nil {
+				return err
+			}
+
+			slices.Sort(resp.Messages)
+			if !slices.Equal(resp.Messages, want) {
+				return fmt.Errorf("%s read %v, want %v", id, resp.Messages, want)
+			}
+		}
+		return nil
+	})
+}
+
+// check records a final read on every node and verifies the history.
+func check(t testing.TB, h *checker.History, c *maelstromtest.Client, nodeIDs []string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, id := range nodeIDs {
+		checker.Record(h, c.ID(), id, "read", nil, func() ([]int, error) {
+			var resp readResponse
+			err := c.RPCInto(ctx, id, map[string]any{"type": "read"}, &resp)
+
+			messages := make([]int, len(resp.Messages))
+			for i, message := range resp.Messages {
+				messages[i] = int(message)
+			}
+			return messages, err
+		})
+	}
+
+	if err := checker.CheckBroadcast(h); err != nil {
+		t.Error(err)
+	}
+}
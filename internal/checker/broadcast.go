@@ -0,0 +1,57 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// CheckBroadcast verifies a broadcast history. Operations are "broadcast"
+// with an int Value and "read" with an []int Result. Every acknowledged
+// message must be present in the last read of every node, and no read may
+// return a message that was never broadcast.
+func CheckBroadcast(h *History) error {
+	ops := h.Ops()
+
+	attempted := map[int]bool{}
+	for _, op := range ops {
+		if op.F == "broadcast" {
+			attempted[op.Value.(int)] = true
+		}
+	}
+
+	var errs []error
+	lastRead := map[string]Op{}
+	for _, op := range filter(ops, "read", OK) {
+		for _, message := range op.Result.([]int) {
+			if !attempted[message] {
+				errs = append(errs, fmt.Errorf("%s read unexpected message %d", op.Node, message))
+			}
+		}
+
+		if last, ok := lastRead[op.Node]; !ok || op.Invoke > last.Invoke {
+			lastRead[op.Node] = op
+		}
+	}
+
+	for _, node := range sortedKeys(lastRead) {
+		read := lastRead[node]
+		for _, op := range filter(ops, "broadcast", OK) {
+			if op.Complete < read.Invoke && !slices.Contains(read.Result.([]int), op.Value.(int)) {
+				errs = append(errs, fmt.Errorf("%s lost acknowledged message %d", node, op.Value.(int)))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
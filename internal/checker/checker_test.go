@@ -0,0 +1,292 @@
+package checker_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// step records a completed operation in h.
+func step(h *checker.History, process, node, f string, value, result any, err error) {
+	op := h.Invoke(process, node, f, value)
+	h.Complete(op, result, err)
+}
+
+func wantAnomaly(t *testing.T, err error, anomaly string) {
+	t.Helper()
+
+	if anomaly == "" {
+		if err != nil {
+			t.Errorf("unexpected anomaly: %v", err)
+		}
+		return
+	}
+
+	if err == nil || !strings.Contains(err.Error(), anomaly) {
+		t.Errorf("error = %v, want %q", err, anomaly)
+	}
+}
+
+func TestCheckBroadcast(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  func(h *checker.History)
+		anomaly string
+	}{
+		{
+			name: "complete",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "broadcast", 1, nil, nil)
+				step(h, "c1", "n1", "broadcast", 2, nil, nil)
+				step(h, "c1", "n0", "read", nil, []int{1, 2}, nil)
+				step(h, "c1", "n1", "read", nil, []int{2, 1}, nil)
+			},
+		},
+		{
+			name: "lost message",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "broadcast", 1, nil, nil)
+				step(h, "c1", "n1", "read", nil, []int{}, nil)
+			},
+			anomaly: "n1 lost acknowledged message 1",
+		},
+		{
+			name: "unexpected message",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "read", nil, []int{7}, nil)
+			},
+			anomaly: "unexpected message 7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h checker.History
+			tt.record(&h)
+			wantAnomaly(t, checker.CheckBroadcast(&h), tt.anomaly)
+		})
+	}
+}
+
+func TestCheckCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  func(h *checker.History)
+		anomaly string
+	}{
+		{
+			name: "converged",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 2, nil, nil)
+				step(h, "c2", "n1", "read", nil, 0, nil)
+				step(h, "c2", "n1", "add", 3, nil, nil)
+				step(h, "c1", "n0", "read", nil, 5, nil)
+			},
+		},
+		{
+			name: "indeterminate add",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 2, nil, errors.New("context deadline exceeded"))
+				step(h, "c1", "n0", "read", nil, 2, nil)
+			},
+		},
+		{
+			name: "failed add observed",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 2, nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, ""))
+				step(h, "c1", "n0", "read", nil, 2, nil)
+			},
+			anomaly: "want between 0 and 0",
+		},
+		{
+			name: "stale final read",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 2, nil, nil)
+				step(h, "c2", "n1", "read", nil, 0, nil)
+			},
+			anomaly: "final read 0 on n1, want at least 2",
+		},
+		{
+			name: "non-monotonic",
+			record: func(h *checker.History) {
+				a := h.Invoke("c1", "n0", "add", 2)
+				step(h, "c2", "n1", "read", nil, 2, nil)
+				step(h, "c2", "n1", "read", nil, 0, nil)
+				h.Complete(a, nil, nil)
+			},
+			anomaly: "read 0 after 2",
+		},
+		{
+			name: "decrements",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 5, nil, nil)
+				step(h, "c2", "n1", "read", nil, 5, nil)
+				step(h, "c1", "n0", "add", -3, nil, nil)
+				step(h, "c2", "n1", "read", nil, 2, nil)
+			},
+		},
+		{
+			name: "indeterminate decrement",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 5, nil, nil)
+				step(h, "c1", "n0", "add", -3, nil, errors.New("context deadline exceeded"))
+				step(h, "c2", "n1", "read", nil, 2, nil)
+				step(h, "c2", "n1", "read", nil, 5, nil)
+			},
+		},
+		{
+			name: "decrement below lower bound",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", -3, nil, nil)
+				step(h, "c2", "n1", "read", nil, -4, nil)
+			},
+			anomaly: "read -4 on n1, want between -3 and 0",
+		},
+		{
+			name: "final read missing decrement",
+			record: func(h *checker.History) {
+				step(h, "c1", "n0", "add", 5, nil, nil)
+				step(h, "c1", "n0", "add", -3, nil, nil)
+				step(h, "c2", "n1", "read", nil, 5, nil)
+			},
+			anomaly: "final read 5 on n1, want at most 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h checker.History
+			tt.record(&h)
+			wantAnomaly(t, checker.CheckCounter(&h), tt.anomaly)
+		})
+	}
+}
+
+func TestCheckKafka(t *testing.T) {
+	send := func(h *checker.History, key string, msg, offset int) {
+		step(h, "c1", "n0", "send", checker.KafkaSend{Key: key, Msg: msg}, offset, nil)
+	}
+	poll := func(h *checker.History, start map[string]int, msgs checker.KafkaMsgs) {
+		step(h, "c1", "n0", "poll", start, msgs, nil)
+	}
+
+	tests := []struct {
+		name    string
+		record  func(h *checker.History)
+		anomaly string
+	}{
+		{
+			name: "valid",
+			record: func(h *checker.History) {
+				send(h, "a", 10, 0)
+				send(h, "a", 11, 1)
+				send(h, "b", 12, 0)
+				poll(h, map[string]int{"a": 0, "b": 0}, checker.KafkaMsgs{"a": {{0, 10}, {1, 11}}, "b": {{0, 12}}})
+			},
+		},
+		{
+			name: "duplicate offset",
+			record: func(h *checker.History) {
+				send(h, "a", 10, 0)
+				send(h, "a", 11, 0)
+			},
+			anomaly: "offset 0 holds both 10 and 11",
+		},
+		{
+			name: "inconsistent poll",
+			record: func(h *checker.History) {
+				send(h, "a", 10, 0)
+				poll(h, map[string]int{"a": 0}, checker.KafkaMsgs{"a": {{0, 99}}})
+			},
+			anomaly: "offset 0 holds both 10 and 99",
+		},
+		{
+			name: "lost write",
+			record: func(h *checker.History) {
+				send(h, "a", 10, 0)
+				send(h, "a", 11, 1)
+				poll(h, map[string]int{"a": 0}, checker.KafkaMsgs{"a": {{1, 11}}})
+			},
+			anomaly: "skipped acknowledged message 10",
+		},
+		{
+			name: "non-monotonic poll",
+			record: func(h *checker.History) {
+				poll(h, map[string]int{"a": 0}, checker.KafkaMsgs{"a": {{1, 11}, {0, 10}}})
+			},
+			anomaly: "offset 0 after 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h checker.History
+			tt.record(&h)
+			wantAnomaly(t, checker.CheckKafka(&h), tt.anomaly)
+		})
+	}
+}
+
+func TestCheckTxn(t *testing.T) {
+	v := func(i int) *int { return &i }
+	r := func(key int, value *int) checker.Mop { return checker.Mop{F: "r", Key: key, Value: value} }
+	w := func(key, value int) checker.Mop { return checker.Mop{F: "w", Key: key, Value: v(value)} }
+	txn := func(h *checker.History, process string, mops ...checker.Mop) {
+		step(h, process, "n0", "txn", mops, mops, nil)
+	}
+
+	tests := []struct {
+		name    string
+		record  func(h *checker.History)
+		anomaly string
+	}{
+		{
+			name: "read committed",
+			record: func(h *checker.History) {
+				txn(h, "c1", w(1, 1), w(2, 1))
+				txn(h, "c2", r(1, v(1)), w(1, 2))
+				txn(h, "c1", r(1, v(2)), r(2, v(1)))
+			},
+		},
+		{
+			name: "G0",
+			record: func(h *checker.History) {
+				txn(h, "c1", r(1, v(2)), w(1, 1), r(2, nil), w(2, 1))
+				txn(h, "c2", r(1, nil), w(1, 2), r(2, v(1)), w(2, 2))
+			},
+			anomaly: "G0",
+		},
+		{
+			name: "G1a",
+			record: func(h *checker.History) {
+				mops := []checker.Mop{w(1, 1)}
+				step(h, "c1", "n0", "txn", mops, nil, maelstrom.NewRPCError(maelstrom.TxnConflict, ""))
+				txn(h, "c2", r(1, v(1)))
+			},
+			anomaly: "G1a",
+		},
+		{
+			name: "G1b",
+			record: func(h *checker.History) {
+				txn(h, "c1", w(1, 1), w(1, 2))
+				txn(h, "c2", r(1, v(1)))
+			},
+			anomaly: "G1b",
+		},
+		{
+			name: "G1c",
+			record: func(h *checker.History) {
+				txn(h, "c1", w(1, 1), r(2, v(1)))
+				txn(h, "c2", w(2, 1), r(1, v(1)))
+			},
+			anomaly: "G1c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h checker.History
+			tt.record(&h)
+			wantAnomaly(t, checker.CheckTxn(&h), tt.anomaly)
+		})
+	}
+}
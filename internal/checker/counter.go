@@ -0,0 +1,91 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CheckCounter verifies an eventually consistent counter history.
+// Operations are "add" with an int Value, which may be negative, and "read"
+// with an int Result.
+//
+// A read must lie between the sums of the negative and of the positive
+// deltas of adds invoked before it completed. Final reads, invoked after
+// every add completed, must observe exactly the acknowledged adds plus any
+// subset of the indeterminate ones. While no delta is negative, reads by the
+// same process on the same node must be monotonic.
+func CheckCounter(h *History) error {
+	ops := h.Ops()
+	adds := filter(ops, "add", OK)
+	maybeAdds := append(filter(ops, "add", Info), filter(ops, "add", Pending)...)
+	allAdds := append(append([]Op(nil), adds...), maybeAdds...)
+
+	// Final reads are invoked after the last add completed. There are none
+	// while an add is still pending.
+	hasFinal := len(filter(ops, "add", Pending)) == 0
+	lastAdd, acknowledged := 0, 0
+	for _, add := range adds {
+		acknowledged += add.Value.(int)
+	}
+	finalLower, finalUpper := acknowledged, acknowledged
+	for _, add := range maybeAdds {
+		lower, upper := deltaRange(add.Value.(int))
+		finalLower += lower
+		finalUpper += upper
+	}
+
+	monotonic := true
+	for _, add := range allAdds {
+		lastAdd = max(lastAdd, add.Complete)
+		if add.Value.(int) < 0 {
+			monotonic = false
+		}
+	}
+
+	var errs []error
+	type session struct{ process, node string }
+	lastRead := map[session]int{}
+
+	for _, read := range filter(ops, "read", OK) {
+		value := read.Result.(int)
+
+		lower, upper := 0, 0
+		for _, add := range allAdds {
+			if add.Invoke < read.Complete {
+				l, u := deltaRange(add.Value.(int))
+				lower += l
+				upper += u
+			}
+		}
+
+		if value < lower || value > upper {
+			errs = append(errs, fmt.Errorf("%s read %d on %s, want between %d and %d", read.Process, value, read.Node, lower, upper))
+		}
+
+		if hasFinal && read.Invoke > lastAdd {
+			switch {
+			case value < finalLower:
+				errs = append(errs, fmt.Errorf("%s final read %d on %s, want at least %d", read.Process, value, read.Node, finalLower))
+			case value > finalUpper:
+				errs = append(errs, fmt.Errorf("%s final read %d on %s, want at most %d", read.Process, value, read.Node, finalUpper))
+			}
+		}
+
+		s := session{read.Process, read.Node}
+		if last, ok := lastRead[s]; ok && monotonic && value < last {
+			errs = append(errs, fmt.Errorf("%s read %d after %d on %s", read.Process, value, last, read.Node))
+		}
+		lastRead[s] = value
+	}
+
+	return errors.Join(errs...)
+}
+
+// deltaRange returns how much an add of delta that may or may not have been
+// applied can lower and raise the counter.
+func deltaRange(delta int) (lower, upper int) {
+	if delta < 0 {
+		return delta, 0
+	}
+	return 0, delta
+}
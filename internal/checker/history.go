@@ -0,0 +1,129 @@
+// Package checker records client operations against in-process Maelstrom
+// nodes and verifies the resulting histories, mirroring the checks Maelstrom
+// runs for each workload.
+package checker
+
+import (
+	"errors"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Status is the outcome of an operation.
+type Status int
+
+const (
+	// Pending operations have been invoked but not completed yet.
+	Pending Status = iota
+	// OK operations definitely took effect.
+	OK
+	// Fail operations definitely did not take effect.
+	Fail
+	// Info operations may or may not have taken effect, e.g. timeouts.
+	Info
+)
+
+// Op is a single client operation. Invoke and Complete are positions in the
+// history, so an operation A precedes B in real time iff A.Complete <
+// B.Invoke.
+type Op struct {
+	Process string
+	Node    string
+	F       string
+	Value   any
+	Result  any
+	Status  Status
+
+	Invoke   int
+	Complete int
+}
+
+// History is a concurrent-safe log of operations.
+type History struct {
+	mu   sync.Mutex
+	ops  []*Op
+	time int
+}
+
+// Invoke records the start of an operation by process against node.
+func (h *History) Invoke(process, node, f string, value any) *Op {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.time++
+	op := &Op{
+		Process: process,
+		Node:    node,
+		F:       f,
+		Value:   value,
+		Invoke:  h.time,
+	}
+	h.ops = append(h.ops, op)
+
+	return op
+}
+
+// Complete records the outcome of op. A nil err completes it as OK, definite
+// Maelstrom errors as Fail and anything else, like timeouts, as Info.
+func (h *History) Complete(op *Op, result any, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.time++
+	op.Complete = h.time
+	op.Result = result
+	op.Status = statusOf(err)
+}
+
+// Record invokes an operation, runs call and completes the operation with
+// its result, typically wrapping a maelstromtest.Client request.
+func Record[T any](h *History, process, node, f string, value any, call func() (T, error)) (T, error) {
+	op := h.Invoke(process, node, f, value)
+	result, err := call()
+	h.Complete(op, result, err)
+
+	return result, err
+}
+
+// Ops returns a copy of all recorded operations in invocation order.
+func (h *History) Ops() []Op {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ops := make([]Op, len(h.ops))
+	for i, op := range h.ops {
+		ops[i] = *op
+	}
+
+	return ops
+}
+
+func statusOf(err error) Status {
+	if err == nil {
+		return OK
+	}
+
+	var rpcErr *maelstrom.RPCError
+	if !errors.As(err, &rpcErr) {
+		return Info
+	}
+
+	switch rpcErr.Code {
+	case maelstrom.Timeout, maelstrom.Crash:
+		return Info
+	default:
+		return Fail
+	}
+}
+
+// filter returns the operations with the given function and status.
+func filter(ops []Op, f string, status Status) []Op {
+	var out []Op
+	for _, op := range ops {
+		if op.F == f && op.Status == status {
+			out = append(out, op)
+		}
+	}
+	return out
+}
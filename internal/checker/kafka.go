@@ -0,0 +1,90 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KafkaSend is the Value of a "send" operation, its Result is the offset.
+type KafkaSend struct {
+	Key string
+	Msg int
+}
+
+// KafkaMsgs maps keys to [offset, msg] pairs, as returned by "poll".
+type KafkaMsgs map[string][][2]int
+
+// CheckKafka verifies a Kafka-style log history. Operations are "send" with
+// a KafkaSend Value and int Result, and "poll" with a map[string]int Value of
+// start offsets and a KafkaMsgs Result.
+//
+// Each offset of a key must hold a single message and each message a single
+// offset, polls must return increasing offsets, and an acknowledged send
+// must not be skipped by a poll that started at or before its offset and
+// returned later ones.
+func CheckKafka(h *History) error {
+	ops := h.Ops()
+
+	type position struct {
+		key    string
+		offset int
+	}
+
+	var errs []error
+	msgAt := map[position]int{}
+	offsetOf := map[int]position{}
+	record := func(p position, msg int) {
+		if prev, ok := msgAt[p]; ok && prev != msg {
+			errs = append(errs, fmt.Errorf("key %s offset %d holds both %d and %d", p.key, p.offset, prev, msg))
+		}
+		msgAt[p] = msg
+
+		if prev, ok := offsetOf[msg]; ok && prev != p {
+			errs = append(errs, fmt.Errorf("message %d stored at %s/%d and %s/%d", msg, prev.key, prev.offset, p.key, p.offset))
+		}
+		offsetOf[msg] = p
+	}
+
+	for _, send := range filter(ops, "send", OK) {
+		value := send.Value.(KafkaSend)
+		record(position{value.Key, send.Result.(int)}, value.Msg)
+	}
+
+	polled := map[position]bool{}
+	polls := filter(ops, "poll", OK)
+	for _, poll := range polls {
+		for key, msgs := range poll.Result.(KafkaMsgs) {
+			for i, pair := range msgs {
+				if i > 0 && pair[0] <= msgs[i-1][0] {
+					errs = append(errs, fmt.Errorf("poll on %s returned offset %d after %d for key %s", poll.Node, pair[0], msgs[i-1][0], key))
+				}
+
+				p := position{key, pair[0]}
+				record(p, pair[1])
+				polled[p] = true
+			}
+		}
+	}
+
+	for _, send := range filter(ops, "send", OK) {
+		p := position{send.Value.(KafkaSend).Key, send.Result.(int)}
+		if polled[p] {
+			continue
+		}
+
+		for _, poll := range polls {
+			start, ok := poll.Value.(map[string]int)[p.key]
+			msgs := poll.Result.(KafkaMsgs)[p.key]
+			if !ok || start > p.offset || poll.Invoke < send.Complete || len(msgs) == 0 {
+				continue
+			}
+
+			if last := msgs[len(msgs)-1][0]; last > p.offset {
+				errs = append(errs, fmt.Errorf("poll on %s skipped acknowledged message %d at key %s offset %d", poll.Node, send.Value.(KafkaSend).Msg, p.key, p.offset))
+				break
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
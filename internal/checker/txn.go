@@ -0,0 +1,191 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Mop is a single read or write in a transaction. Value is nil for reads of
+// missing keys and for reads in the request.
+type Mop struct {
+	F     string
+	Key   int
+	Value *int
+}
+
+// CheckTxn verifies a txn-rw-register history of "txn" operations whose
+// Value is the requested []Mop and Result the completed []Mop. Written values
+// must be unique per key, as in Maelstrom's workload.
+//
+// It reports the anomalies proscribed by read committed:
+//   - G0: a cycle of write-write dependencies,
+//   - G1a: a read of a value written by a failed transaction,
+//   - G1b: a read of a value that a transaction later overwrote itself,
+//   - G1c: a cycle of write-write and write-read dependencies.
+//
+// Write-write order is inferred from transactions that read a key and then
+// write it.
+func CheckTxn(h *History) error {
+	ops := h.Ops()
+	txns := filter(ops, "txn", OK)
+
+	type version struct{ key, value int }
+
+	writer := map[version]int{}
+	intermediate := map[version]bool{}
+	failed := map[version]bool{}
+
+	for i, txn := range txns {
+		final := map[int]int{}
+		for _, mop := range txn.Result.([]Mop) {
+			if mop.F != "w" {
+				continue
+			}
+
+			if prev, ok := final[mop.Key]; ok {
+				intermediate[version{mop.Key, prev}] = true
+			}
+			final[mop.Key] = *mop.Value
+			writer[version{mop.Key, *mop.Value}] = i
+		}
+	}
+
+	for _, txn := range filter(ops, "txn", Fail) {
+		for _, mop := range txn.Value.([]Mop) {
+			if mop.F == "w" {
+				failed[version{mop.Key, *mop.Value}] = true
+			}
+		}
+	}
+
+	var errs []error
+	ww := newGraph(len(txns))
+	wr := newGraph(len(txns))
+
+	for i, txn := range txns {
+		written := map[int]bool{}
+		for _, mop := range txn.Result.([]Mop) {
+			if mop.F == "w" {
+				written[mop.Key] = true
+				continue
+			}
+			if mop.Value == nil || written[mop.Key] {
+				continue
+			}
+
+			v := version{mop.Key, *mop.Value}
+			switch {
+			case failed[v]:
+				errs = append(errs, fmt.Errorf("G1a: %s read key %d = %d written by a failed transaction", txn.Process, v.key, v.value))
+			case intermediate[v]:
+				errs = append(errs, fmt.Errorf("G1b: %s read intermediate value %d of key %d", txn.Process, v.value, v.key))
+			}
+
+			w, ok := writer[v]
+			if !ok || w == i {
+				continue
+			}
+			wr.add(w, i)
+
+			if txnWrites(txn.Result.([]Mop), mop.Key) {
+				ww.add(w, i)
+			}
+		}
+	}
+
+	if cycle := ww.cycle(); cycle != nil {
+		errs = append(errs, fmt.Errorf("G0: write cycle between %s", describe(txns, cycle)))
+	} else if cycle := ww.union(wr).cycle(); cycle != nil {
+		errs = append(errs, fmt.Errorf("G1c: dependency cycle between %s", describe(txns, cycle)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func txnWrites(mops []Mop, key int) bool {
+	return slices.ContainsFunc(mops, func(mop Mop) bool {
+		return mop.F == "w" && mop.Key == key
+	})
+}
+
+// describe names the transactions in a cycle by process and invocation time.
+func describe(txns []Op, cycle []int) string {
+	names := make([]string, len(cycle))
+	for i, t := range cycle {
+		names[i] = fmt.Sprintf("%s@%d", txns[t].Process, txns[t].Invoke)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// graph is a directed graph over transaction indexes.
+type graph [][]int
+
+func newGraph(n int) graph {
+	return make(graph, n)
+}
+
+func (g graph) add(from, to int) {
+	if !slices.Contains(g[from], to) {
+		g[from] = append(g[from], to)
+	}
+}
+
+func (g graph) union(other graph) graph {
+	out := newGraph(len(g))
+	for from := range g {
+		for _, to := range g[from] {
+			out.add(from, to)
+		}
+		for _, to := range other[from] {
+			out.add(from, to)
+		}
+	}
+	return out
+}
+
+// cycle returns the nodes of some cycle in g, closed by repeating the first
+// node, or nil if g is acyclic.
+func (g graph) cycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := make([]int, len(g))
+	var stack []int
+
+	var visit func(n int) []int
+	visit = func(n int) []int {
+		state[n] = visiting
+		stack = append(stack, n)
+
+		for _, next := range g[n] {
+			switch state[next] {
+			case visiting:
+				start := slices.Index(stack, next)
+				return append(slices.Clone(stack[start:]), next)
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[n] = done
+		return nil
+	}
+
+	for n := range g {
+		if state[n] == unvisited {
+			if cycle := visit(n); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
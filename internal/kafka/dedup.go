@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// DedupWindow is how many of the latest sends of a producer to a key are
+// remembered, so a retry is recognised as long as the producer has fewer
+// sends to the key in flight.
+const DedupWindow = 5
+
+// Sequences remembers the offsets of the latest sends of every producer to
+// every key, by the sequence numbers the producer gave them. Callers
+// synchronize access.
+type Sequences struct {
+	byProducer map[producerKey][]sequenced
+}
+
+type producerKey struct {
+	producer, key string
+}
+
+type sequenced struct {
+	seq, offset int
+}
+
+// Lookup returns the offset of the send seq of producer to key if it was
+// already appended. A send older than the remembered ones can't be told
+// apart from a new one, so it's rejected.
+func (s *Sequences) Lookup(producer, key string, seq int) (offset int, ok bool, err error) {
+	sent := s.byProducer[producerKey{producer, key}]
+	if len(sent) == 0 || seq > sent[len(sent)-1].seq {
+		return 0, false, nil
+	}
+
+	for _, prev := range sent {
+		if prev.seq == seq {
+			return prev.offset, true, nil
+		}
+	}
+
+	return 0, false, maelstromx.Errorf(maelstrom.PreconditionFailed,
+		"send %d of producer %q to %q is older than its last %d sends", seq, producer, key, len(sent))
+}
+
+// Record remembers that the send seq of producer to key got offset.
+func (s *Sequences) Record(producer, key string, seq, offset int) {
+	if s.byProducer == nil {
+		s.byProducer = make(map[producerKey][]sequenced)
+	}
+
+	k := producerKey{producer, key}
+	sent := append(s.byProducer[k], sequenced{seq: seq, offset: offset})
+	if len(sent) > DedupWindow {
+		sent = sent[len(sent)-DedupWindow:]
+	}
+	s.byProducer[k] = sent
+}
+
+// Forget drops the sends to key at offset and later, which a new leader
+// replaced.
+func (s *Sequences) Forget(key string, offset int) {
+	for k, sent := range s.byProducer {
+		if k.key != key {
+			continue
+		}
+
+		sent = slices.DeleteFunc(sent, func(prev sequenced) bool { return prev.offset >= offset })
+		if len(sent) == 0 {
+			delete(s.byProducer, k)
+		} else {
+			s.byProducer[k] = sent
+		}
+	}
+}
+
+// ValidateProducer checks that producer_id and seq of a send come together.
+func ValidateProducer(producer string, seq *int) error {
+	switch {
+	case producer == "" && seq != nil:
+		return fmt.Errorf("seq %d without producer_id", *seq)
+	case producer != "" && seq == nil:
+		return fmt.Errorf("producer_id %q without seq", producer)
+	case seq != nil && *seq < 0:
+		return fmt.Errorf("negative seq %d", *seq)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultGroup holds the offsets committed by requests without a group.
+const DefaultGroup = "default"
+
+// GroupName returns the name offsets of group are committed under.
+func GroupName(group string) string {
+	if group == "" {
+		return DefaultGroup
+	}
+	return group
+}
+
+// ValidateGroup rejects ':' in group names, which the multi-node log uses to
+// separate group names in its storage keys.
+func ValidateGroup(group string) error {
+	if strings.Contains(group, ":") {
+		return fmt.Errorf("group %q must not contain ':'", group)
+	}
+	return nil
+}
+
+// OffsetsMsg is the body of list_committed_offsets replies.
+type OffsetsMsg struct {
+	Offsets map[string]int `json:"offsets"`
+}
+
+type CommitOffsetsRequest struct {
+	Group   string         `json:"group"`
+	Offsets map[string]int `json:"offsets"`
+}
+
+func (r CommitOffsetsRequest) Validate() error {
+	return ValidateGroup(r.Group)
+}
+
+type ListCommittedOffsetsRequest struct {
+	Group string   `json:"group"`
+	Keys  []string `json:"keys"`
+}
+
+func (r ListCommittedOffsetsRequest) Validate() error {
+	return ValidateGroup(r.Group)
+}
+
+type ListGroupsResponse struct {
+	Groups []string `json:"groups"`
+}
+
+type DeleteGroupRequest struct {
+	Group string `json:"group"`
+}
+
+func (r DeleteGroupRequest) Validate() error {
+	return ValidateGroup(r.Group)
+}
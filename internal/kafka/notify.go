@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// MaxPollWait caps wait_ms, so a parked poll is answered before the client
+// gives up on it.
+const MaxPollWait = 5 * time.Second
+
+// Notifier wakes up polls waiting for new messages. Every key has a channel
+// that is closed, and replaced by the next subscriber, when the key changes.
+type Notifier struct {
+	mu      sync.Mutex
+	changed map[string]chan struct{}
+}
+
+// subscribe returns the channels closed by the next change of each key.
+func (n *Notifier) subscribe(keys []string) []<-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.changed == nil {
+		n.changed = make(map[string]chan struct{})
+	}
+
+	chans := make([]<-chan struct{}, 0, len(keys))
+	for _, key := range keys {
+		ch, ok := n.changed[key]
+		if !ok {
+			ch = make(chan struct{})
+			n.changed[key] = ch
+		}
+		chans = append(chans, ch)
+	}
+
+	return chans
+}
+
+// Notify wakes up the polls waiting for key.
+func (n *Notifier) Notify(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ch, ok := n.changed[key]; ok {
+		close(ch)
+		delete(n.changed, key)
+	}
+}
+
+// LongPoll calls poll until it finds messages or waitMs, capped at
+// MaxPollWait, passes without a change of keys, and returns its last result.
+// park, unless nil, is called before every wait with the time left.
+func LongPoll[Resp any](n *Notifier, keys []string, waitMs int, poll func() (resp Resp, found bool, err error), park func(wait time.Duration)) (Resp, error) {
+	deadline := time.Now().Add(min(time.Duration(waitMs)*time.Millisecond, MaxPollWait))
+
+	for {
+		// Subscribe before polling, so a message appended in between still
+		// wakes the poll up.
+		var changed []<-chan struct{}
+		if waitMs > 0 {
+			changed = n.subscribe(keys)
+		}
+
+		resp, found, err := poll()
+		if err != nil {
+			return resp, err
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 || found {
+			return resp, nil
+		}
+
+		if park != nil {
+			park(wait)
+		}
+		if !waitAny(changed, wait) {
+			return resp, nil
+		}
+	}
+}
+
+// waitAny blocks until one of chans is closed or timeout passes, and reports
+// whether a channel was closed.
+func waitAny(chans []<-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	cases := make([]reflect.SelectCase, 0, len(chans)+1)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	for _, ch := range chans {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+
+	chosen, _, _ := reflect.Select(cases)
+	return chosen != 0
+}
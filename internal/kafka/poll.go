@@ -0,0 +1,34 @@
+package kafka
+
+import "fmt"
+
+type PollRequest struct {
+	Offsets map[string]int `json:"offsets"`
+	// WaitMs parks a poll that finds no messages until one of its keys gets
+	// a message or the time runs out.
+	WaitMs int `json:"wait_ms"`
+}
+
+func (r PollRequest) Validate() error {
+	if r.WaitMs < 0 {
+		return fmt.Errorf("negative wait_ms %d", r.WaitMs)
+	}
+	return nil
+}
+
+type PollResponse struct {
+	Msgs map[string][][]any `json:"msgs"`
+	// Truncated maps keys polled from a truncated offset to the first
+	// retained offset, where their messages start instead.
+	Truncated map[string]int `json:"truncated,omitempty"`
+}
+
+// HasMessages reports whether resp returns a message of any key.
+func HasMessages(resp PollResponse) bool {
+	for _, msgs := range resp.Msgs {
+		if len(msgs) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+// Package kafka holds the parts of the Kafka-style logs shared by the
+// single- and multi-node solutions.
+package kafka
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Retention limits how many messages each log keeps. Polls for truncated
+// offsets start at the first retained offset instead.
+type Retention struct {
+	// MaxMessages keeps only the newest messages of a key, unless zero.
+	MaxMessages int
+	// BelowCommitted drops messages below the offset committed for the key
+	// by every consumer group. A group that didn't commit the key keeps all
+	// of its messages.
+	BelowCommitted bool
+}
+
+// RetentionFromEnv reads the retention policy from
+// KAFKA_RETENTION_MAX_MESSAGES and KAFKA_RETENTION_COMMITTED.
+func RetentionFromEnv() (Retention, error) {
+	var cfg Retention
+
+	if maxMessages := os.Getenv("KAFKA_RETENTION_MAX_MESSAGES"); maxMessages != "" {
+		n, err := strconv.Atoi(maxMessages)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid KAFKA_RETENTION_MAX_MESSAGES %q", maxMessages)
+		}
+		cfg.MaxMessages = n
+	}
+	cfg.BelowCommitted = os.Getenv("KAFKA_RETENTION_COMMITTED") == "true"
+
+	return cfg, nil
+}
@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type SendRequest struct {
+	Key string          `json:"key"`
+	Msg json.RawMessage `json:"msg"`
+	// ProducerID and Seq make the send idempotent: a retried send with the
+	// same producer, key and sequence number returns the original offset.
+	ProducerID string `json:"producer_id,omitempty"`
+	Seq        *int   `json:"seq,omitempty"`
+}
+
+func (r SendRequest) Validate() error {
+	if r.Key == "" {
+		return errors.New("missing key")
+	}
+	if len(r.Msg) == 0 {
+		return errors.New("missing msg")
+	}
+	return ValidateProducer(r.ProducerID, r.Seq)
+}
+
+type SendResponse struct {
+	Offset int `json:"offset"`
+}
+
+type SendBatchRequest struct {
+	Msgs []SendRequest `json:"msgs"`
+}
+
+func (r SendBatchRequest) Validate() error {
+	for i, m := range r.Msgs {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+	return validateBatchSeqs(r.Msgs)
+}
+
+type SendBatchResponse struct {
+	// Offsets holds the offset of every message of the batch, in order.
+	Offsets []int `json:"offsets"`
+}
+
+// validateBatchSeqs checks that the sequence numbers of every producer and
+// key increase within a batch.
+func validateBatchSeqs(msgs []SendRequest) error {
+	last := map[producerKey]int{}
+	for _, m := range msgs {
+		if m.ProducerID == "" {
+			continue
+		}
+
+		k := producerKey{m.ProducerID, m.Key}
+		if prev, ok := last[k]; ok && *m.Seq <= prev {
+			return fmt.Errorf("seq %d of producer %q to %q doesn't increase within the batch", *m.Seq, m.ProducerID, m.Key)
+		}
+		last[k] = *m.Seq
+	}
+	return nil
+}
+
+// CheckBatch fails if one of reqs, a validated batch, would be rejected, so
+// the batch can be rejected before any of it is appended. Sequence numbers
+// increase within the batch, so the checks can't fail once appending
+// started.
+func (s *Sequences) CheckBatch(reqs []SendRequest) error {
+	for _, req := range reqs {
+		if req.ProducerID == "" {
+			continue
+		}
+		if _, _, err := s.Lookup(req.ProducerID, req.Key, *req.Seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
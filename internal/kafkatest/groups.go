@@ -0,0 +1,102 @@
+// Package kafkatest holds the client scenarios the single- and multi-node
+// Kafka-style logs are both tested with.
+package kafkatest
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// ConsumerGroups checks that groups committing to node track offsets
+// independently and can be listed and deleted.
+func ConsumerGroups(ctx context.Context, t testing.TB, c *maelstromtest.Client, node string) {
+	t.Helper()
+
+	commit := func(group string, offsets map[string]int) {
+		t.Helper()
+
+		body := map[string]any{"type": "commit_offsets", "offsets": offsets}
+		if group != "" {
+			body["group"] = group
+		}
+		if _, err := c.RPC(ctx, node, body); err != nil {
+			t.Fatalf("commit %v to %q: %v", offsets, group, err)
+		}
+	}
+
+	list := func(group string) map[string]int {
+		t.Helper()
+
+		body := map[string]any{"type": "list_committed_offsets", "keys": []string{"a", "b"}}
+		if group != "" {
+			body["group"] = group
+		}
+		var resp struct {
+			Offsets map[string]int `json:"offsets"`
+		}
+		if err := c.RPCInto(ctx, node, body, &resp); err != nil {
+			t.Fatalf("list committed offsets of %q: %v", group, err)
+		}
+		return resp.Offsets
+	}
+
+	groups := func() []string {
+		t.Helper()
+
+		var resp struct {
+			Groups []string `json:"groups"`
+		}
+		if err := c.RPCInto(ctx, node, map[string]any{"type": "list_groups"}, &resp); err != nil {
+			t.Fatalf("list groups: %v", err)
+		}
+		return resp.Groups
+	}
+
+	commit("", map[string]int{"a": 1})
+	commit("billing", map[string]int{"a": 5, "b": 2})
+	commit("audit", map[string]int{"b": 7})
+	commit("billing", map[string]int{"a": 3})
+
+	for group, want := range map[string]map[string]int{
+		"":        {"a": 1},
+		"default": {"a": 1},
+		"billing": {"a": 5, "b": 2},
+		"audit":   {"b": 7},
+		"unknown": {},
+	} {
+		if got := list(group); !maps.Equal(got, want) {
+			t.Errorf("committed offsets of %q = %v, want %v", group, got, want)
+		}
+	}
+
+	if got, want := groups(), []string{"audit", "billing", "default"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+
+	if _, err := c.RPC(ctx, node, map[string]any{"type": "delete_group", "group": "billing"}); err != nil {
+		t.Fatalf("delete group: %v", err)
+	}
+
+	if got, want := groups(), []string{"audit", "default"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups after delete = %v, want %v", got, want)
+	}
+	if got := list("billing"); len(got) != 0 {
+		t.Errorf("committed offsets of deleted group = %v, want none", got)
+	}
+
+	// A deleted group starts over when it commits again.
+	commit("billing", map[string]int{"a": 2})
+	if got, want := list("billing"), map[string]int{"a": 2}; !maps.Equal(got, want) {
+		t.Errorf("committed offsets of recreated group = %v, want %v", got, want)
+	}
+
+	_, err := c.RPC(ctx, node, map[string]any{"type": "commit_offsets", "group": "a:b", "offsets": map[string]int{"a": 1}})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Errorf("commit to group a:b: got error %v, want MalformedRequest", err)
+	}
+}
@@ -0,0 +1,147 @@
+package kafkatest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/kafka"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// IdempotentSend checks that retried sends return their original offsets
+// and append nothing. Consecutive sends go through different nodes.
+func IdempotentSend(ctx context.Context, t testing.TB, c *maelstromtest.Client, nodes []string) {
+	t.Helper()
+
+	send := func(node, producer, key string, seq, msg int) (int, error) {
+		body := map[string]any{"type": "send", "key": key, "msg": msg}
+		if producer != "" {
+			body["producer_id"] = producer
+			body["seq"] = seq
+		}
+		var resp struct {
+			Offset int `json:"offset"`
+		}
+		err := c.RPCInto(ctx, node, body, &resp)
+		return resp.Offset, err
+	}
+
+	for i, tt := range []struct {
+		producer string
+		key      string
+		seq, msg int
+		want     int
+	}{
+		{producer: "p1", key: "a", seq: 0, msg: 10, want: 0},
+		{producer: "p1", key: "a", seq: 1, msg: 11, want: 1},
+		{producer: "p1", key: "a", seq: 1, msg: 11, want: 1},
+		{producer: "p1", key: "a", seq: 0, msg: 10, want: 0},
+		// Sequence numbers are tracked per producer and key.
+		{producer: "p2", key: "a", seq: 1, msg: 20, want: 2},
+		{producer: "p1", key: "b", seq: 1, msg: 12, want: 0},
+		// Sends without a producer are never deduplicated.
+		{key: "a", msg: 30, want: 3},
+		{key: "a", msg: 30, want: 4},
+		{producer: "p1", key: "a", seq: 2, msg: 13, want: 5},
+		{producer: "p1", key: "a", seq: 2, msg: 13, want: 5},
+	} {
+		node := nodes[i%len(nodes)]
+		got, err := send(node, tt.producer, tt.key, tt.seq, tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("send %d of %q to %s via %s got offset %d, want %d", tt.seq, tt.producer, tt.key, node, got, tt.want)
+		}
+	}
+
+	for i := range kafka.DedupWindow {
+		if _, err := send(nodes[0], "p1", "a", 3+i, 14+i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := send(nodes[0], "p1", "a", 2, 13); maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+		t.Errorf("send older than the last %d: got error %v, want PreconditionFailed", kafka.DedupWindow, err)
+	}
+
+	_, err := c.RPC(ctx, nodes[0], map[string]any{"type": "send", "key": "a", "msg": 1, "producer_id": "p1"})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Errorf("send without seq: got error %v, want MalformedRequest", err)
+	}
+}
+
+// SendBatch checks that batches sent through nodes get consecutive
+// offsets per key, interleaved with single sends.
+func SendBatch(ctx context.Context, t testing.TB, c *maelstromtest.Client, nodes []string) {
+	t.Helper()
+
+	sendBatch := func(node string, msgs []map[string]any) ([]int, error) {
+		var resp struct {
+			Offsets []int `json:"offsets"`
+		}
+		err := c.RPCInto(ctx, node, map[string]any{"type": "send_batch", "msgs": msgs}, &resp)
+		return resp.Offsets, err
+	}
+
+	if _, err := c.RPC(ctx, nodes[0], map[string]any{"type": "send", "key": "a", "msg": 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	offsets, err := sendBatch(nodes[len(nodes)-1], []map[string]any{
+		{"key": "a", "msg": 101},
+		{"key": "b", "msg": 200},
+		{"key": "a", "msg": 102, "producer_id": "p1", "seq": 0},
+		{"key": "c", "msg": 300},
+		{"key": "b", "msg": 201},
+		{"key": "a", "msg": 103},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 0, 2, 0, 1, 3}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("send_batch offsets = %v, want %v", offsets, want)
+	}
+
+	// Retried messages keep their offsets, new ones follow the last batch.
+	offsets, err = sendBatch(nodes[0], []map[string]any{
+		{"key": "a", "msg": 102, "producer_id": "p1", "seq": 0},
+		{"key": "a", "msg": 104, "producer_id": "p1", "seq": 1},
+		{"key": "b", "msg": 202},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 4, 2}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("retried send_batch offsets = %v, want %v", offsets, want)
+	}
+
+	for _, node := range nodes {
+		var resp struct {
+			Msgs map[string][][2]int `json:"msgs"`
+		}
+		if err := c.RPCInto(ctx, node, map[string]any{"type": "poll", "offsets": map[string]int{"a": 0, "b": 0, "c": 0}}, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string][][2]int{
+			"a": {{0, 100}, {1, 101}, {2, 102}, {3, 103}, {4, 104}},
+			"b": {{0, 200}, {1, 201}, {2, 202}},
+			"c": {{0, 300}},
+		}
+		if !reflect.DeepEqual(resp.Msgs, want) {
+			t.Errorf("poll on %s = %v, want %v", node, resp.Msgs, want)
+		}
+	}
+
+	for name, msgs := range map[string][]map[string]any{
+		"missing key":          {{"msg": 1}},
+		"decreasing seq":       {{"key": "a", "msg": 1, "producer_id": "p1", "seq": 5}, {"key": "a", "msg": 2, "producer_id": "p1", "seq": 4}},
+		"seq without producer": {{"key": "a", "msg": 1, "seq": 5}},
+	} {
+		if _, err := sendBatch(nodes[0], msgs); maelstrom.ErrorCode(err) != maelstrom.MalformedRequest {
+			t.Errorf("send_batch with %s: got error %v, want MalformedRequest", name, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package maelstromtest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Client sends requests to nodes on behalf of a Maelstrom client such as
+// "c1".
+type Client struct {
+	id  string
+	net *Network
+
+	mu        sync.Mutex
+	nextMsgID int
+	callbacks map[int]chan maelstrom.Message
+}
+
+// ID returns the client identifier used as the message source.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// RPC sends body to dest and waits for the reply. Error replies are returned
+// as *maelstrom.RPCError, like maelstrom.Node.SyncRPC, including ones with
+// the zero maelstrom.Timeout code.
+func (c *Client) RPC(ctx context.Context, dest string, body any) (maelstrom.Message, error) {
+	c.mu.Lock()
+	c.nextMsgID++
+	msgID := c.nextMsgID
+	respCh := make(chan maelstrom.Message, 1)
+	c.callbacks[msgID] = respCh
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.callbacks, msgID)
+		c.mu.Unlock()
+	}()
+
+	reqBody, err := withField(body, "msg_id", msgID)
+	if err != nil {
+		return maelstrom.Message{}, err
+	}
+
+	c.net.send(c.id, dest, reqBody)
+
+	select {
+	case <-ctx.Done():
+		return maelstrom.Message{}, ctx.Err()
+	case msg := <-respCh:
+		return msg, replyError(msg)
+	}
+}
+
+// RPCInto sends body to dest and decodes the reply body into resp.
+func (c *Client) RPCInto(ctx context.Context, dest string, body, resp any) error {
+	msg, err := c.RPC(ctx, dest, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(msg.Body, resp)
+}
+
+func (c *Client) receive(msg maelstrom.Message) {
+	var body maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	respCh := c.callbacks[body.InReplyTo]
+	delete(c.callbacks, body.InReplyTo)
+	c.mu.Unlock()
+
+	if respCh != nil {
+		respCh <- msg
+	}
+}
+
+func replyError(msg maelstrom.Message) error {
+	var body maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.Crash, err.Error())
+	}
+	if body.Type != "error" {
+		return nil
+	}
+
+	return maelstrom.NewRPCError(body.Code, body.Text)
+}
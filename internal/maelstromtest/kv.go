@@ -0,0 +1,161 @@
+package maelstromtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// KV implements Maelstrom's key/value services: "read", "write" and "cas"
+// with create_if_not_exists, answering KeyDoesNotExist and
+// PreconditionFailed like the real ones.
+//
+// Writes and CAS always apply to the latest state. A seq-kv read may instead
+// return an older state, but never one older than the client has already
+// observed, while an lww-kv read may return any older state. lin-kv reads are
+// never stale.
+type KV struct {
+	typ string
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	staleRate float64
+	version   int
+	history   map[string][]kvVersion
+	observed  map[string]int
+}
+
+type kvVersion struct {
+	version int
+	value   any
+}
+
+// NewKV returns a service of the given type, one of maelstrom.LinKV,
+// maelstrom.SeqKV or maelstrom.LWWKV, using rng to pick stale reads.
+func NewKV(typ string, rng *rand.Rand) *KV {
+	return &KV{
+		typ:      typ,
+		rng:      rng,
+		history:  map[string][]kvVersion{},
+		observed: map[string]int{},
+	}
+}
+
+// AddKV registers a new KV service of the given type under its standard
+// name, seeded from the network's random source.
+func (n *Network) AddKV(typ string) *KV {
+	n.mu.Lock()
+	kv := NewKV(typ, rand.New(rand.NewSource(n.rng.Int63())))
+	n.mu.Unlock()
+
+	n.AddService(typ, kv)
+	return kv
+}
+
+// SetStaleRate makes reads of seq-kv and lww-kv return an older state with
+// probability p.
+func (kv *KV) SetStaleRate(p float64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.staleRate = p
+}
+
+type kvRequest struct {
+	Type              string          `json:"type"`
+	Key               string          `json:"key"`
+	Value             json.RawMessage `json:"value"`
+	From              json.RawMessage `json:"from"`
+	To                json.RawMessage `json:"to"`
+	CreateIfNotExists bool            `json:"create_if_not_exists"`
+}
+
+// Handle implements Service.
+func (kv *KV) Handle(msg maelstrom.Message) any {
+	var req kvRequest
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	switch req.Type {
+	case "read":
+		value, ok := kv.read(msg.Src, req.Key)
+		if !ok {
+			return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist, "key does not exist")
+		}
+		return map[string]any{"type": "read_ok", "value": value}
+
+	case "write":
+		kv.write(msg.Src, req.Key, decodeValue(req.Value))
+		return map[string]any{"type": "write_ok"}
+
+	case "cas":
+		current, ok := kv.latest(req.Key)
+		switch {
+		case !ok && !req.CreateIfNotExists:
+			return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist, "key does not exist")
+		case ok && !reflect.DeepEqual(current, decodeValue(req.From)):
+			return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "current value does not match from")
+		}
+
+		kv.write(msg.Src, req.Key, decodeValue(req.To))
+		return map[string]any{"type": "cas_ok"}
+
+	default:
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "unsupported operation "+req.Type)
+	}
+}
+
+func (kv *KV) latest(key string) (any, bool) {
+	versions := kv.history[key]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	return versions[len(versions)-1].value, true
+}
+
+// read returns the value of key at a version chosen for client.
+func (kv *KV) read(client, key string) (any, bool) {
+	at := kv.version
+	if kv.typ != maelstrom.LinKV && kv.staleRate > 0 && kv.rng.Float64() < kv.staleRate {
+		floor := 0
+		if kv.typ == maelstrom.SeqKV {
+			floor = kv.observed[client]
+		}
+		at = floor + kv.rng.Intn(kv.version-floor+1)
+	}
+	kv.observed[client] = max(kv.observed[client], at)
+
+	versions := kv.history[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].version <= at {
+			return versions[i].value, true
+		}
+	}
+	return nil, false
+}
+
+func (kv *KV) write(client, key string, value any) {
+	kv.version++
+	kv.history[key] = append(kv.history[key], kvVersion{version: kv.version, value: value})
+	kv.observed[client] = kv.version
+}
+
+// decodeValue decodes a JSON value keeping numbers exact, so values sent by
+// different clients can be compared.
+func decodeValue(raw json.RawMessage) any {
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil
+	}
+	return value
+}
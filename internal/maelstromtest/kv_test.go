@@ -0,0 +1,192 @@
+package maelstromtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// kvCall sends body to kv as client and returns the decoded reply.
+func kvCall(t *testing.T, kv *maelstromtest.KV, client string, body map[string]any) map[string]any {
+	t.Helper()
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := json.Marshal(kv.Handle(maelstrom.Message{Src: client, Dest: "kv", Body: raw}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp map[string]any
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestKV(t *testing.T) {
+	kv := maelstromtest.NewKV(maelstrom.LinKV, rand.New(rand.NewSource(1)))
+
+	tests := []struct {
+		name string
+		body map[string]any
+		want map[string]any
+	}{
+		{
+			name: "read missing key",
+			body: map[string]any{"type": "read", "key": "x"},
+			want: map[string]any{"type": "error", "code": float64(maelstrom.KeyDoesNotExist)},
+		},
+		{
+			name: "cas missing key",
+			body: map[string]any{"type": "cas", "key": "x", "from": 0, "to": 1},
+			want: map[string]any{"type": "error", "code": float64(maelstrom.KeyDoesNotExist)},
+		},
+		{
+			name: "cas create",
+			body: map[string]any{"type": "cas", "key": "x", "from": 0, "to": 1, "create_if_not_exists": true},
+			want: map[string]any{"type": "cas_ok"},
+		},
+		{
+			name: "cas mismatch",
+			body: map[string]any{"type": "cas", "key": "x", "from": 0, "to": 2},
+			want: map[string]any{"type": "error", "code": float64(maelstrom.PreconditionFailed)},
+		},
+		{
+			name: "cas match",
+			body: map[string]any{"type": "cas", "key": "x", "from": 1, "to": 2},
+			want: map[string]any{"type": "cas_ok"},
+		},
+		{
+			name: "write",
+			body: map[string]any{"type": "write", "key": "y", "value": []int{1, 2}},
+			want: map[string]any{"type": "write_ok"},
+		},
+		{
+			name: "read",
+			body: map[string]any{"type": "read", "key": "x"},
+			want: map[string]any{"type": "read_ok", "value": float64(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := kvCall(t, kv, "n0", tt.body)
+			for key, want := range tt.want {
+				if got := resp[key]; got != want {
+					t.Errorf("reply[%q] = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKV_staleReads(t *testing.T) {
+	tests := []struct {
+		typ           string
+		wantStale     bool
+		wantMonotonic bool
+	}{
+		{typ: maelstrom.LinKV, wantStale: false, wantMonotonic: true},
+		{typ: maelstrom.SeqKV, wantStale: true, wantMonotonic: true},
+		{typ: maelstrom.LWWKV, wantStale: true, wantMonotonic: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			kv := maelstromtest.NewKV(tt.typ, rand.New(rand.NewSource(1)))
+			kv.SetStaleRate(0.5)
+
+			for i := range 10 {
+				kvCall(t, kv, "n0", map[string]any{"type": "write", "key": "x", "value": i})
+			}
+
+			stale := false
+			for i := range 20 {
+				resp := kvCall(t, kv, fmt.Sprintf("c%d", i), map[string]any{"type": "read", "key": "x"})
+				if value, _ := resp["value"].(float64); resp["type"] != "read_ok" || value < 9 {
+					stale = true
+				}
+			}
+
+			monotonic := true
+			last := -1.0
+			for range 100 {
+				resp := kvCall(t, kv, "n1", map[string]any{"type": "read", "key": "x"})
+				value, ok := resp["value"].(float64)
+				if !ok {
+					value = -1
+				}
+				if value < last {
+					monotonic = false
+				}
+				last = value
+			}
+
+			if stale != tt.wantStale {
+				t.Errorf("stale reads = %v, want %v", stale, tt.wantStale)
+			}
+			if monotonic != tt.wantMonotonic {
+				t.Errorf("monotonic reads = %v, want %v", monotonic, tt.wantMonotonic)
+			}
+
+			kvCall(t, kv, "n1", map[string]any{"type": "write", "key": "y", "value": 0})
+			if tt.typ == maelstrom.SeqKV {
+				resp := kvCall(t, kv, "n1", map[string]any{"type": "read", "key": "x"})
+				if resp["value"] != float64(9) {
+					t.Errorf("read after own write = %v, want 9", resp["value"])
+				}
+			}
+		})
+	}
+}
+
+func TestNetwork_AddKV(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(2, func(node *maelstrom.Node) {
+		kv := maelstrom.NewLinKV(node)
+		maelstromx.Handle(node, "incr", func(msg maelstrom.Message, req struct{}) (struct{}, error) {
+			for {
+				value, err := kv.ReadInt(context.Background(), "counter")
+				if err != nil && maelstrom.ErrorCode(err) != maelstrom.KeyDoesNotExist {
+					return struct{}{}, err
+				}
+
+				err = kv.CompareAndSwap(context.Background(), "counter", value, value+1, true)
+				if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+					return struct{}{}, err
+				}
+			}
+		})
+	})
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for i := range 10 {
+		if _, err := c.RPC(ctx, net.NodeIDs()[i%2], map[string]any{"type": "incr"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var resp struct {
+		Value int `json:"value"`
+	}
+	if err := c.RPCInto(ctx, maelstrom.LinKV, map[string]any{"type": "read", "key": "counter"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Value != 10 {
+		t.Errorf("counter = %d, want 10", resp.Value)
+	}
+}
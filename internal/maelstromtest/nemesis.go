@@ -0,0 +1,200 @@
+package maelstromtest
+
+import (
+	"slices"
+	"time"
+)
+
+// Faults are only injected into messages between nodes. Clients and
+// services are always reachable, like in Maelstrom.
+
+type link struct {
+	from, to string
+}
+
+type latency struct {
+	min, max time.Duration
+}
+
+// nemesis holds the faults currently applied to the network. It is guarded
+// by Network.mu and all randomness comes from the seeded Network.rng.
+type nemesis struct {
+	blocked       map[link]bool
+	dropRate      float64
+	duplicateRate float64
+	reorderRate   float64
+	reorderWindow time.Duration
+	latency       latency
+	linkLatency   map[link]latency
+}
+
+// Partition splits nodes into groups that cannot reach each other. Nodes not
+// listed in any group form one more group.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	groupOf := map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			groupOf[id] = i + 1
+		}
+	}
+
+	n.nemesis.blocked = map[link]bool{}
+	for _, from := range n.nodeIDs {
+		for _, to := range n.nodeIDs {
+			if groupOf[from] != groupOf[to] {
+				n.nemesis.blocked[link{from, to}] = true
+			}
+		}
+	}
+}
+
+// Isolate cuts id off from every other node.
+func (n *Network) Isolate(id string) {
+	n.Partition([]string{id})
+}
+
+// PartitionHalves splits nodes randomly into a majority and a minority and
+// returns both groups.
+func (n *Network) PartitionHalves() (majority, minority []string) {
+	shuffled := n.shuffledNodeIDs()
+	minority, majority = shuffled[:len(shuffled)/2], shuffled[len(shuffled)/2:]
+
+	n.Partition(majority, minority)
+	return majority, minority
+}
+
+// Bridge splits nodes randomly into two halves that can only communicate
+// through a single bridge node connected to both, and returns the bridge.
+func (n *Network) Bridge() string {
+	shuffled := n.shuffledNodeIDs()
+	mid := len(shuffled) / 2
+	bridge := shuffled[mid]
+	left, right := shuffled[:mid], shuffled[mid+1:]
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.blocked = map[link]bool{}
+	for _, from := range left {
+		for _, to := range right {
+			n.nemesis.blocked[link{from, to}] = true
+			n.nemesis.blocked[link{to, from}] = true
+		}
+	}
+
+	return bridge
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.blocked = nil
+}
+
+// SetDropRate makes every message between nodes lost with probability p.
+func (n *Network) SetDropRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.dropRate = p
+}
+
+// SetDuplicateRate makes every message between nodes delivered twice with
+// probability p.
+func (n *Network) SetDuplicateRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.duplicateRate = p
+}
+
+// SetReorderRate delays every message between nodes with probability p by a
+// random extra duration up to window, letting later messages overtake it.
+func (n *Network) SetReorderRate(p float64, window time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.reorderRate = p
+	n.nemesis.reorderWindow = window
+}
+
+// SetLatency delays every message between nodes by a random duration in
+// [min, max].
+func (n *Network) SetLatency(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nemesis.latency = latency{min, max}
+}
+
+// SetLinkLatency overrides the latency of messages sent from one node to
+// another.
+func (n *Network) SetLinkLatency(from, to string, min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nemesis.linkLatency == nil {
+		n.nemesis.linkLatency = map[link]latency{}
+	}
+	n.nemesis.linkLatency[link{from, to}] = latency{min, max}
+}
+
+// delays returns when each copy of a message from one node to another should
+// be delivered. No delays means the message is lost. Must be called with
+// n.mu held.
+func (n *Network) delays(from, to string) []time.Duration {
+	nem := &n.nemesis
+	l := link{from, to}
+
+	if nem.blocked[l] || n.chance(nem.dropRate) {
+		return nil
+	}
+
+	copies := 1
+	if n.chance(nem.duplicateRate) {
+		copies = 2
+	}
+
+	lat, ok := nem.linkLatency[l]
+	if !ok {
+		lat = nem.latency
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.between(lat.min, lat.max)
+		if n.chance(nem.reorderRate) {
+			delays[i] += n.between(0, nem.reorderWindow)
+		}
+	}
+
+	return delays
+}
+
+func (n *Network) chance(p float64) bool {
+	return p > 0 && n.rng.Float64() < p
+}
+
+func (n *Network) between(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(n.rng.Int63n(int64(max-min)+1))
+}
+
+func (n *Network) shuffledNodeIDs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	shuffled := slices.Clone(n.nodeIDs)
+	n.rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return shuffled
+}
@@ -0,0 +1,167 @@
+package maelstromtest_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// relayTimeout bounds node-to-node RPCs in these tests, so that lost
+// messages surface as errors quickly.
+const relayTimeout = 200 * time.Millisecond
+
+func relay(c *maelstromtest.Client, from, to string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.RPC(ctx, from, map[string]any{"type": "relay", "to": to})
+	return err
+}
+
+func timeoutRelayNode(node *maelstrom.Node) {
+	maelstromx.Handle(node, "ping", func(msg maelstrom.Message, req struct{}) (struct{}, error) {
+		return struct{}{}, nil
+	})
+
+	maelstromx.Handle(node, "relay", func(msg maelstrom.Message, req struct {
+		To string `json:"to"`
+	}) (struct{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+		defer cancel()
+
+		if _, err := node.SyncRPC(ctx, req.To, map[string]any{"type": "ping"}); err != nil {
+			return struct{}{}, maelstromx.Errorf(maelstrom.TemporarilyUnavailable, "%v", err)
+		}
+		return struct{}{}, nil
+	})
+}
+
+func TestNetwork_Partition(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, timeoutRelayNode)
+	net.Start()
+
+	c := net.Client()
+
+	net.Partition([]string{"n0", "n1"}, []string{"n2"})
+	if err := relay(c, "n0", "n1"); err != nil {
+		t.Errorf("n0 -> n1 in the same group: %v", err)
+	}
+	if err := relay(c, "n0", "n2"); maelstrom.ErrorCode(err) != maelstrom.TemporarilyUnavailable {
+		t.Errorf("n0 -> n2 across partition: got %v, want unavailable", err)
+	}
+
+	net.Heal()
+	if err := relay(c, "n0", "n2"); err != nil {
+		t.Errorf("n0 -> n2 after heal: %v", err)
+	}
+
+	net.Isolate("n1")
+	if err := relay(c, "n2", "n1"); maelstrom.ErrorCode(err) != maelstrom.TemporarilyUnavailable {
+		t.Errorf("n2 -> n1 isolated: got %v, want unavailable", err)
+	}
+	if err := relay(c, "n2", "n0"); err != nil {
+		t.Errorf("n2 -> n0: %v", err)
+	}
+}
+
+func TestNetwork_Bridge(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(5, timeoutRelayNode)
+	net.Start()
+
+	c := net.Client()
+	bridge := net.Bridge()
+
+	for _, id := range net.NodeIDs() {
+		if err := relay(c, bridge, id); err != nil && id != bridge {
+			t.Errorf("bridge %s -> %s: %v", bridge, id, err)
+		}
+	}
+}
+
+func TestNetwork_PartitionHalvesIsDeterministic(t *testing.T) {
+	halves := func() ([]string, []string) {
+		net := maelstromtest.NewNetwork(t, maelstromtest.WithSeed(42))
+		net.AddNodes(5, timeoutRelayNode)
+		return net.PartitionHalves()
+	}
+
+	majority1, minority1 := halves()
+	majority2, minority2 := halves()
+
+	if !slices.Equal(majority1, majority2) || !slices.Equal(minority1, minority2) {
+		t.Errorf("same seed gave %v/%v and %v/%v", majority1, minority1, majority2, minority2)
+	}
+	if len(majority1) != 3 || len(minority1) != 2 {
+		t.Errorf("halves %v/%v, want sizes 3/2", majority1, minority1)
+	}
+}
+
+func TestNetwork_DropAndDuplicate(t *testing.T) {
+	var pings atomic.Int64
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) {
+		maelstromx.HandleNoReply(node, "ping", func(msg maelstrom.Message, req struct{}) error {
+			pings.Add(1)
+			return nil
+		})
+		maelstromx.Handle(node, "fire", func(msg maelstrom.Message, req struct{}) (struct{}, error) {
+			return struct{}{}, node.Send("n1", map[string]any{"type": "ping"})
+		})
+	})
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c := net.Client()
+
+	net.SetDropRate(1)
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "fire"}); err != nil {
+		t.Fatal(err)
+	}
+
+	net.SetDropRate(0)
+	net.SetDuplicateRate(1)
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "fire"}); err != nil {
+		t.Fatal(err)
+	}
+
+	maelstromtest.Eventually(t, time.Second, func() error {
+		if got := pings.Load(); got != 2 {
+			return errors.New("waiting for duplicated ping")
+		}
+		return nil
+	})
+}
+
+func TestNetwork_Latency(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, timeoutRelayNode)
+	net.Start()
+
+	c := net.Client()
+
+	net.SetLatency(5*time.Millisecond, 10*time.Millisecond)
+	net.SetLinkLatency("n1", "n2", 2*relayTimeout, 2*relayTimeout)
+
+	start := time.Now()
+	if err := relay(c, "n0", "n1"); err != nil {
+		t.Fatalf("n0 -> n1: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("round trip took %v, want at least 10ms", elapsed)
+	}
+
+	if err := relay(c, "n1", "n2"); maelstrom.ErrorCode(err) != maelstrom.TemporarilyUnavailable {
+		t.Errorf("n1 -> n2 over slow link: got %v, want unavailable", err)
+	}
+}
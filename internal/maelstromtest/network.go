@@ -0,0 +1,535 @@
+// Package maelstromtest runs Maelstrom nodes in-process on an in-memory
+// message bus so their behavior can be tested with go test.
+package maelstromtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// initTimeout bounds the init handshake with every node.
+const initTimeout = 5 * time.Second
+
+// rpcExpiry is how long replies to a request of a node are mapped back to
+// it, longer than any test waits for a reply.
+const rpcExpiry = time.Minute
+
+// Service handles messages addressed to a built-in service such as "lin-kv".
+// The returned body is sent back as a reply, a nil body means no reply.
+type Service interface {
+	Handle(msg maelstrom.Message) any
+}
+
+// Network routes messages between nodes, clients and services. Nodes are
+// regular *maelstrom.Node instances whose STDIN/STDOUT are connected to the
+// network instead of the process.
+type Network struct {
+	t testing.TB
+
+	mu       sync.Mutex
+	nodeIDs  []string
+	nodes    map[string]*endpoint
+	services map[string]Service
+	clients  map[string]*Client
+	closed   bool
+
+	// rpcs maps the msg_ids requests of nodes are sent with to the node
+	// and its own msg_id, so replies reach the node that sent the request.
+	// Entries are kept until they expire, as a duplicated request is
+	// answered twice, and expire in msg_id order from oldestMsgID on.
+	rpcs        map[int]rpc
+	nextMsgID   int
+	oldestMsgID int
+
+	seed    int64
+	rng     *rand.Rand
+	nemesis nemesis
+}
+
+// Option configures a Network.
+type Option func(*Network)
+
+// WithSeed seeds the random source used for fault injection, so that a
+// failing test can be reproduced with the seed it logged.
+func WithSeed(seed int64) Option {
+	return func(n *Network) {
+		n.seed = seed
+	}
+}
+
+// NewNetwork returns an empty network that is closed when the test ends.
+// Node logs are discarded unless the test runs with -v. Without WithSeed a
+// time-based seed is used and logged.
+func NewNetwork(t testing.TB, opts ...Option) *Network {
+	n := &Network{
+		t:        t,
+		nodes:    map[string]*endpoint{},
+		services: map[string]Service{},
+		clients:  map[string]*Client{},
+		rpcs:     map[int]rpc{},
+		seed:     time.Now().UnixNano(),
+	}
+
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.rng = rand.New(rand.NewSource(n.seed))
+	t.Logf("maelstromtest: seed %d", n.seed)
+
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		t.Cleanup(func() { log.SetOutput(defaultLogOutput) })
+	}
+	t.Cleanup(n.Close)
+
+	return n
+}
+
+var defaultLogOutput = log.Writer()
+
+// AddNode creates a node with the given ID and starts its event loop. setup
+// registers handlers on the node, typically by constructing the server under
+// test. Nodes receive the init message in Start.
+func (n *Network) AddNode(id string, setup func(node *maelstrom.Node)) {
+	e := n.startNode(id, setup)
+
+	n.mu.Lock()
+	n.nodeIDs = append(n.nodeIDs, id)
+	n.nodes[id] = e
+	n.mu.Unlock()
+}
+
+// Restart kills node id and starts a new node with the same ID in its
+// place, like a crashed process coming back. Messages not yet delivered to
+// the old node are lost, as are replies to its requests, and its output
+// from then on is dropped. Messages to the new node are held back until it
+// acknowledged init. Restart waits for the handlers of the old node to
+// return, sets up the new one and sends it the init message.
+func (n *Network) Restart(id string, setup func(node *maelstrom.Node)) {
+	n.t.Helper()
+
+	n.mu.Lock()
+	old := n.nodes[id]
+	n.mu.Unlock()
+	if old == nil {
+		n.t.Fatalf("restart unknown node %q", id)
+	}
+
+	old.close()
+	<-old.done
+
+	e := n.startNode(id, setup)
+	n.mu.Lock()
+	n.nodes[id] = e
+	n.mu.Unlock()
+
+	n.init(id)
+}
+
+// startNode creates a node with the given ID and starts its event loop.
+func (n *Network) startNode(id string, setup func(node *maelstrom.Node)) *endpoint {
+	node := maelstrom.NewNode()
+	stdin, stdinW := io.Pipe()
+
+	e := &endpoint{id: id, node: node, stdin: stdinW, done: make(chan struct{})}
+	e.cond = sync.NewCond(&e.mu)
+
+	node.Stdin = stdin
+	node.Stdout = &lineWriter{deliver: func(line []byte) {
+		if !e.isClosed() {
+			n.deliverFrom(e, line)
+		}
+	}}
+	setup(node)
+
+	go e.pump()
+	go func() {
+		defer close(e.done)
+		if err := node.Run(); err != nil {
+			n.errorf("node %s: %v", id, err)
+		}
+	}()
+
+	return e
+}
+
+// AddNodes adds nodes n0..n<count-1> with the same setup function.
+func (n *Network) AddNodes(count int, setup func(node *maelstrom.Node)) {
+	for i := range count {
+		n.AddNode(fmt.Sprintf("n%d", i), setup)
+	}
+}
+
+// AddService registers svc to handle messages sent to id.
+func (n *Network) AddService(id string, svc Service) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.services[id] = svc
+}
+
+// NodeIDs returns the IDs of all nodes in the order they were added.
+func (n *Network) NodeIDs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]string{}, n.nodeIDs...)
+}
+
+// Start sends the init message to every node and waits for all of them to
+// acknowledge it.
+func (n *Network) Start() {
+	n.t.Helper()
+
+	for _, id := range n.NodeIDs() {
+		n.init(id)
+	}
+}
+
+// init sends the init message to node id and waits for the reply.
+func (n *Network) init(id string) {
+	n.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	defer cancel()
+
+	_, err := n.Client().RPC(ctx, id, map[string]any{
+		"type":     "init",
+		"node_id":  id,
+		"node_ids": n.NodeIDs(),
+	})
+	if err != nil {
+		n.t.Fatalf("init %s: %v", id, err)
+	}
+
+	n.mu.Lock()
+	n.nodes[id].setReady()
+	n.mu.Unlock()
+}
+
+// Close stops delivering messages and closes STDIN of every node.
+func (n *Network) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+	n.closed = true
+
+	for _, e := range n.nodes {
+		e.close()
+	}
+}
+
+// Client returns a new client with a unique ID that can send requests to
+// nodes.
+func (n *Network) Client() *Client {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := &Client{
+		id:        fmt.Sprintf("c%d", len(n.clients)+1),
+		net:       n,
+		callbacks: map[int]chan maelstrom.Message{},
+	}
+	n.clients[c.id] = c
+
+	return c
+}
+
+// rpc is a request sent by a node.
+type rpc struct {
+	from  *endpoint
+	msgID int
+	sent  time.Time
+}
+
+// deliver routes a single message written by a client or service.
+func (n *Network) deliver(line []byte) {
+	n.deliverFrom(nil, line)
+}
+
+// deliverFrom routes a single message written by a node, client or service.
+// from is the node that wrote it, if any.
+//
+// A restarted node numbers its requests from scratch, so requests of nodes
+// get msg_ids unique across the network and replies are mapped back to the
+// node that sent the request. Replies to nodes are always to such requests,
+// so a reply without a mapping is dropped rather than delivered with a
+// msg_id the node never used.
+func (n *Network) deliverFrom(from *endpoint, line []byte) {
+	var msg maelstrom.Message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		n.errorf("malformed message %s: %v", line, err)
+		return
+	}
+	var body maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		n.errorf("malformed message body %s: %v", msg.Body, err)
+		return
+	}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	node := n.nodes[msg.Dest]
+
+	rewrite := map[string]int{}
+	if from != nil && body.MsgID != 0 {
+		n.expireRPCs()
+		n.nextMsgID++
+		n.rpcs[n.nextMsgID] = rpc{from: from, msgID: body.MsgID, sent: time.Now()}
+		rewrite["msg_id"] = n.nextMsgID
+	}
+	if node != nil && body.InReplyTo != 0 {
+		req, ok := n.rpcs[body.InReplyTo]
+		if !ok || req.from != node {
+			// The request expired or was sent by a node since restarted.
+			n.mu.Unlock()
+			return
+		}
+		rewrite["in_reply_to"] = req.msgID
+	}
+
+	client := n.clients[msg.Dest]
+	svc := n.services[msg.Dest]
+
+	delays := []time.Duration{0}
+	if _, fromNode := n.nodes[msg.Src]; fromNode && node != nil {
+		delays = n.delays(msg.Src, msg.Dest)
+	}
+	n.mu.Unlock()
+
+	for key, value := range rewrite {
+		var err error
+		if msg.Body, err = withField(msg.Body, key, value); err != nil {
+			n.errorf("rewrite %s of %s: %v", key, line, err)
+			return
+		}
+		if line, err = json.Marshal(msg); err != nil {
+			n.errorf("marshal message: %v", err)
+			return
+		}
+	}
+
+	init := body.Type == "init"
+	switch {
+	case node != nil:
+		for _, delay := range delays {
+			if delay == 0 {
+				node.enqueue(line, init)
+				continue
+			}
+			time.AfterFunc(delay, func() { node.enqueue(line, init) })
+		}
+	case client != nil:
+		client.receive(msg)
+	case svc != nil:
+		go n.serve(svc, msg)
+	default:
+		n.errorf("message to unknown destination %q: %s", msg.Dest, line)
+	}
+}
+
+// expireRPCs forgets the requests of nodes sent more than rpcExpiry ago.
+// n.mu must be held.
+func (n *Network) expireRPCs() {
+	for ; n.oldestMsgID <= n.nextMsgID; n.oldestMsgID++ {
+		req, ok := n.rpcs[n.oldestMsgID]
+		if ok && time.Since(req.sent) < rpcExpiry {
+			return
+		}
+		delete(n.rpcs, n.oldestMsgID)
+	}
+}
+
+// serve passes msg to svc and routes its reply back to the sender.
+func (n *Network) serve(svc Service, msg maelstrom.Message) {
+	resp := svc.Handle(msg)
+	if resp == nil {
+		return
+	}
+
+	var req maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		n.errorf("malformed service request %s: %v", msg.Body, err)
+		return
+	}
+
+	body, err := withField(resp, "in_reply_to", req.MsgID)
+	if err != nil {
+		n.errorf("service reply: %v", err)
+		return
+	}
+
+	n.send(msg.Dest, msg.Src, body)
+}
+
+// send marshals and delivers a message from src to dest.
+func (n *Network) send(src, dest string, body json.RawMessage) {
+	line, err := json.Marshal(maelstrom.Message{Src: src, Dest: dest, Body: body})
+	if err != nil {
+		n.errorf("marshal message: %v", err)
+		return
+	}
+
+	n.deliver(line)
+}
+
+// withField returns body encoded as a JSON object with key set to value.
+// Numbers in body are kept exact.
+func withField(body any, key string, value any) (json.RawMessage, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	m[key] = value
+
+	return json.Marshal(m)
+}
+
+// errorf reports an error unless the network is already closed, in which
+// case the test may have finished.
+func (n *Network) errorf(format string, args ...any) {
+	n.mu.Lock()
+	closed := n.closed
+	n.mu.Unlock()
+
+	if !closed {
+		n.t.Errorf(format, args...)
+	}
+}
+
+// endpoint queues messages for a node and feeds them to its STDIN in order.
+// The queue is unbounded so that a node writing to a slow peer never blocks.
+type endpoint struct {
+	id    string
+	node  *maelstrom.Node
+	stdin *io.PipeWriter
+	// done is closed when the node's event loop returns.
+	done chan struct{}
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	// ready is set once the node acknowledged init. Until then only init
+	// is fed to the node and other messages are held back.
+	ready bool
+	held  [][]byte
+}
+
+// enqueue queues line for the node. init marks the init message.
+func (e *endpoint) enqueue(line []byte, init bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+	if !e.ready && !init {
+		e.held = append(e.held, line)
+		return
+	}
+	e.queue = append(e.queue, line)
+	e.cond.Signal()
+}
+
+func (e *endpoint) pump() {
+	for {
+		e.mu.Lock()
+		for len(e.queue) == 0 && !e.closed {
+			e.cond.Wait()
+		}
+		if e.closed {
+			e.mu.Unlock()
+			return
+		}
+		line := e.queue[0]
+		e.queue = e.queue[1:]
+		e.mu.Unlock()
+
+		if _, err := e.stdin.Write(append(line, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+// setReady feeds the node the messages held back while it started.
+func (e *endpoint) setReady() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.ready = true
+	e.queue = append(e.queue, e.held...)
+	e.held = nil
+	e.cond.Signal()
+}
+
+func (e *endpoint) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.closed
+}
+
+func (e *endpoint) close() {
+	e.mu.Lock()
+	e.closed = true
+	e.cond.Signal()
+	e.mu.Unlock()
+
+	e.stdin.Close()
+}
+
+// lineWriter splits node output into newline-terminated messages.
+type lineWriter struct {
+	mu      sync.Mutex
+	buf     []byte
+	deliver func(line []byte)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.buf = append(w.buf, p...)
+
+	var lines [][]byte
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, append([]byte{}, w.buf[:i]...))
+		w.buf = w.buf[i+1:]
+	}
+	w.mu.Unlock()
+
+	for _, line := range lines {
+		if len(strings.TrimSpace(string(line))) > 0 {
+			w.deliver(line)
+		}
+	}
+
+	return len(p), nil
+}
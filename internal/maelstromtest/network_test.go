@@ -0,0 +1,312 @@
+package maelstromtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type pingResponse struct {
+	From string `json:"from"`
+}
+
+// relayNode answers "ping" directly and forwards "relay" as a ping to the
+// next node, replying with the answer.
+func relayNode(node *maelstrom.Node) {
+	maelstromx.Handle(node, "ping", func(msg maelstrom.Message, req struct{}) (pingResponse, error) {
+		return pingResponse{From: node.ID()}, nil
+	})
+
+	maelstromx.Handle(node, "relay", func(msg maelstrom.Message, req struct {
+		To string `json:"to"`
+	}) (pingResponse, error) {
+		resp, err := node.SyncRPC(context.Background(), req.To, map[string]any{"type": "ping"})
+		if err != nil {
+			return pingResponse{}, err
+		}
+
+		var body pingResponse
+		return body, json.Unmarshal(resp.Body, &body)
+	})
+}
+
+func TestNetwork_RPC(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, relayNode)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+	for _, id := range net.NodeIDs() {
+		var resp pingResponse
+		if err := c.RPCInto(ctx, id, map[string]any{"type": "ping"}, &resp); err != nil {
+			t.Fatalf("ping %s: %v", id, err)
+		}
+		if resp.From != id {
+			t.Errorf("ping %s answered by %q", id, resp.From)
+		}
+	}
+
+	var resp pingResponse
+	if err := c.RPCInto(ctx, "n0", map[string]any{"type": "relay", "to": "n2"}, &resp); err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if resp.From != "n2" {
+		t.Errorf("relay answered by %q, want n2", resp.From)
+	}
+}
+
+func TestNetwork_RPCError(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(1, relayNode)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := net.Client().RPC(ctx, "n0", map[string]any{"type": "relay", "to": 5})
+	if code := maelstrom.ErrorCode(err); code != maelstrom.MalformedRequest {
+		t.Errorf("error code = %d, want %d", code, maelstrom.MalformedRequest)
+	}
+}
+
+type echoService struct{}
+
+func (echoService) Handle(msg maelstrom.Message) any {
+	return map[string]any{"type": "echo_ok", "from": msg.Src}
+}
+
+func TestNetwork_Service(t *testing.T) {
+	net := maelstromtest.NewNetwork(t)
+	net.AddService("echo", echoService{})
+	net.AddNodes(1, func(node *maelstrom.Node) {
+		maelstromx.Handle(node, "ping", func(msg maelstrom.Message, req struct{}) (pingResponse, error) {
+			resp, err := node.SyncRPC(context.Background(), "echo", map[string]any{"type": "echo"})
+			if err != nil {
+				return pingResponse{}, err
+			}
+
+			var body pingResponse
+			return body, json.Unmarshal(resp.Body, &body)
+		})
+	})
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var resp pingResponse
+	if err := net.Client().RPCInto(ctx, "n0", map[string]any{"type": "ping"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.From != "n0" {
+		t.Errorf("service saw sender %q, want n0", resp.From)
+	}
+}
+
+func TestNetwork_Restart(t *testing.T) {
+	// Every node counts the pings it answered, which a restart resets.
+	counter := func(node *maelstrom.Node) {
+		var count atomic.Int64
+		maelstromx.Handle(node, "ping", func(msg maelstrom.Message, req struct{}) (map[string]int64, error) {
+			return map[string]int64{"count": count.Add(1)}, nil
+		})
+	}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, counter)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := net.Client()
+	ping := func(id string) int64 {
+		t.Helper()
+
+		var resp struct {
+			Count int64 `json:"count"`
+		}
+		if err := c.RPCInto(ctx, id, map[string]any{"type": "ping"}, &resp); err != nil {
+			t.Fatalf("ping %s: %v", id, err)
+		}
+		return resp.Count
+	}
+
+	for range 3 {
+		ping("n0")
+		ping("n1")
+	}
+
+	net.Restart("n0", counter)
+
+	if got := ping("n0"); got != 1 {
+		t.Errorf("restarted n0 answered ping %d, want 1", got)
+	}
+	if got := ping("n1"); got != 4 {
+		t.Errorf("n1 answered ping %d, want 4", got)
+	}
+}
+
+func TestNetwork_RestartDropsOldReplies(t *testing.T) {
+	type echo struct {
+		Value     int `json:"value"`
+		DelayMs   int `json:"delay_ms"`
+		TimeoutMs int `json:"timeout_ms"`
+	}
+	// n0 relays calls to n1, which echoes them after a delay.
+	setup := func(node *maelstrom.Node) {
+		maelstromx.Handle(node, "call", func(msg maelstrom.Message, req echo) (echo, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeoutMs)*time.Millisecond)
+			defer cancel()
+
+			resp, err := node.SyncRPC(ctx, "n1", map[string]any{"type": "echo", "value": req.Value, "delay_ms": req.DelayMs})
+			if err != nil {
+				return echo{}, err
+			}
+			var got echo
+			return got, json.Unmarshal(resp.Body, &got)
+		})
+		maelstromx.Handle(node, "echo", func(msg maelstrom.Message, req echo) (echo, error) {
+			time.Sleep(time.Duration(req.DelayMs) * time.Millisecond)
+			return echo{Value: req.Value}, nil
+		})
+	}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, setup)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// The old n0 gives up on its call before n1 replies, so the reply
+	// arrives once n0 restarted.
+	c := net.Client()
+	body := map[string]any{"type": "call", "value": 1, "delay_ms": 300, "timeout_ms": 100}
+	if err := c.RPCInto(ctx, "n0", body, &echo{}); err == nil {
+		t.Fatal("call answered before n1 replied")
+	}
+
+	// The new n0 sends its request with the same msg_id as the old one,
+	// which must not get the reply to the old request.
+	net.Restart("n0", setup)
+
+	var resp echo
+	body = map[string]any{"type": "call", "value": 2, "delay_ms": 400, "timeout_ms": 1000}
+	if err := c.RPCInto(ctx, "n0", body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Value != 2 {
+		t.Errorf("restarted n0 got echo %d, want 2", resp.Value)
+	}
+}
+
+func TestNetwork_DuplicateReplies(t *testing.T) {
+	// n0 pings n1, which answers after a delay, and meanwhile sends holds
+	// to n2, which never answers them.
+	var misrouted atomic.Int64
+	setup := func(node *maelstrom.Node) {
+		relayNode(node)
+		node.Handle("hold", func(msg maelstrom.Message) error { return nil })
+		maelstromx.Handle(node, "slow_ping", func(msg maelstrom.Message, req struct{}) (pingResponse, error) {
+			time.Sleep(100 * time.Millisecond)
+			return pingResponse{From: node.ID()}, nil
+		})
+		maelstromx.Handle(node, "probe", func(msg maelstrom.Message, req struct{}) (struct{}, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// The duplicated ping is answered twice. The second reply must
+			// not reach any of the holds, whose msg_ids are as high as the
+			// one the network gave the ping.
+			if _, err := node.SyncRPC(ctx, "n1", map[string]any{"type": "slow_ping"}); err != nil {
+				return struct{}{}, err
+			}
+			return struct{}{}, nil
+		})
+		maelstromx.Handle(node, "hold_many", func(msg maelstrom.Message, req struct{}) (struct{}, error) {
+			for range 10 {
+				err := node.RPC("n2", map[string]any{"type": "hold"}, func(msg maelstrom.Message) error {
+					misrouted.Add(1)
+					return nil
+				})
+				if err != nil {
+					return struct{}{}, err
+				}
+			}
+			return struct{}{}, nil
+		})
+	}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(3, setup)
+	net.Start()
+	net.SetDuplicateRate(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	c := net.Client()
+	// Requests of n1 move the network's msg_ids ahead of n0's own.
+	for range 3 {
+		if _, err := c.RPC(ctx, "n1", map[string]any{"type": "relay", "to": "n2"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.RPC(ctx, "n0", map[string]any{"type": "probe"})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.RPC(ctx, "n0", map[string]any{"type": "hold_many"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := misrouted.Load(); got != 0 {
+		t.Errorf("%d replies reached holds n2 never answered", got)
+	}
+}
+
+func TestNetwork_HoldsMessagesUntilInit(t *testing.T) {
+	// n0 greets n1 as soon as it's initialized, before n1 is.
+	var greeted atomic.Int64
+	setup := func(node *maelstrom.Node) {
+		node.Handle("init", func(msg maelstrom.Message) error {
+			if node.ID() == "n0" {
+				return node.Send("n1", map[string]any{"type": "hello"})
+			}
+			return nil
+		})
+		node.Handle("hello", func(msg maelstrom.Message) error {
+			greeted.Add(1)
+			return nil
+		})
+	}
+
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, setup)
+	net.Start()
+
+	maelstromtest.Eventually(t, time.Second, func() error {
+		if greeted.Load() != 1 {
+			return errors.New("n1 wasn't greeted")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,29 @@
+package maelstromtest
+
+import (
+	"testing"
+	"time"
+)
+
+// pollInterval is how often Eventually re-evaluates its condition.
+const pollInterval = 20 * time.Millisecond
+
+// Eventually calls cond until it returns nil and fails the test with the last
+// error if that does not happen within timeout.
+func Eventually(t testing.TB, timeout time.Duration, cond func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met after %v: %v", timeout, err)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,128 @@
+// Package maelstromx registers typed message handlers on a maelstrom.Node.
+package maelstromx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// HandlerFunc handles a decoded request and returns the reply body.
+type HandlerFunc[Req, Resp any] func(msg maelstrom.Message, req Req) (Resp, error)
+
+// Validator is implemented by request types that check their own fields.
+type Validator interface {
+	Validate() error
+}
+
+// Handle registers fn for messages of type typ. The message body is decoded
+// into Req and, if Req implements Validator, validated; bad input is rejected
+// with a MalformedRequest error. The returned Resp is sent back as a reply of
+// type "<typ>_ok", and a returned *maelstrom.RPCError as an "error" reply.
+func Handle[Req, Resp any](node *maelstrom.Node, typ string, fn HandlerFunc[Req, Resp]) {
+	node.Handle(typ, func(msg maelstrom.Message) error {
+		req, err := decode[Req](msg)
+		if err != nil {
+			return replyError(node, msg, err)
+		}
+
+		resp, err := fn(msg, req)
+		if err != nil {
+			return replyError(node, msg, err)
+		}
+
+		return Reply(node, msg, typ+"_ok", resp)
+	})
+}
+
+type errorBody struct {
+	Code int    `json:"code"`
+	Text string `json:"text,omitempty"`
+}
+
+// replyError replies with err if it is an RPC error. Unlike
+// maelstrom.Node.Reply, the code is always included, as maelstrom.Timeout
+// is zero and would otherwise be dropped from the body. Other errors are
+// left to the node, which replies with a crash error.
+func replyError(node *maelstrom.Node, req maelstrom.Message, err error) error {
+	var rpcErr *maelstrom.RPCError
+	if !errors.As(err, &rpcErr) {
+		return err
+	}
+
+	return Reply(node, req, "error", errorBody{Code: rpcErr.Code, Text: rpcErr.Text})
+}
+
+// HandleNoReply registers fn for messages of type typ that are not answered,
+// such as one-way notifications between nodes.
+func HandleNoReply[Req any](node *maelstrom.Node, typ string, fn func(msg maelstrom.Message, req Req) error) {
+	node.Handle(typ, func(msg maelstrom.Message) error {
+		req, err := decode[Req](msg)
+		if err != nil {
+			return err
+		}
+
+		return fn(msg, req)
+	})
+}
+
+// Reply sends body to the sender of req as a message of the given type.
+// Unlike maelstrom.Node.Reply, numbers in body are kept exact.
+func Reply(node *maelstrom.Node, req maelstrom.Message, typ string, body any) error {
+	var reqBody maelstrom.MessageBody
+	if err := json.Unmarshal(req.Body, &reqBody); err != nil {
+		return err
+	}
+
+	out, err := toMap(body)
+	if err != nil {
+		return err
+	}
+	out["type"] = typ
+	out["in_reply_to"] = reqBody.MsgID
+
+	return node.Send(req.Src, out)
+}
+
+// Errorf returns an RPC error with the given Maelstrom error code.
+func Errorf(code int, format string, args ...any) *maelstrom.RPCError {
+	return maelstrom.NewRPCError(code, fmt.Sprintf(format, args...))
+}
+
+func decode[Req any](msg maelstrom.Message) (Req, error) {
+	var req Req
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		return req, Errorf(maelstrom.MalformedRequest, "decode %s: %v", msg.Type(), err)
+	}
+
+	if v, ok := any(&req).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return req, Errorf(maelstrom.MalformedRequest, "invalid %s: %v", msg.Type(), err)
+		}
+	}
+
+	return req, nil
+}
+
+func toMap(body any) (map[string]any, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+	if bytes.Equal(buf, []byte("null")) {
+		return out, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&out); err != nil {
+		return nil, fmt.Errorf("reply body must be a JSON object: %w", err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,150 @@
+package maelstromx_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type addRequest struct {
+	Delta int `json:"delta"`
+}
+
+func (r addRequest) Validate() error {
+	if r.Delta < 0 {
+		return errors.New("delta must not be negative")
+	}
+	return nil
+}
+
+type addResponse struct {
+	Total int64 `json:"total"`
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]any
+	}{
+		{
+			name: "valid request",
+			body: `{"type":"add","msg_id":1,"delta":5}`,
+			want: map[string]any{"type": "add_ok", "in_reply_to": float64(1), "total": float64(5)},
+		},
+		{
+			name: "wrong field type",
+			body: `{"type":"add","msg_id":2,"delta":"five"}`,
+			want: map[string]any{"type": "error", "in_reply_to": float64(2), "code": float64(maelstrom.MalformedRequest)},
+		},
+		{
+			name: "failed validation",
+			body: `{"type":"add","msg_id":3,"delta":-1}`,
+			want: map[string]any{"type": "error", "in_reply_to": float64(3), "code": float64(maelstrom.MalformedRequest)},
+		},
+		{
+			name: "timeout",
+			body: `{"type":"add","msg_id":4,"delta":99}`,
+			want: map[string]any{"type": "error", "in_reply_to": float64(4), "code": float64(maelstrom.Timeout)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := maelstrom.NewNode()
+			maelstromx.Handle(node, "add", func(msg maelstrom.Message, req addRequest) (addResponse, error) {
+				if req.Delta == 99 {
+					return addResponse{}, maelstromx.Errorf(maelstrom.Timeout, "timed out")
+				}
+				return addResponse{Total: int64(req.Delta)}, nil
+			})
+
+			replies := run(t, node, tt.body)
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(replies))
+			}
+
+			for key, want := range tt.want {
+				if got := replies[0][key]; got != want {
+					t.Errorf("reply[%q] = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleNoReply(t *testing.T) {
+	node := maelstrom.NewNode()
+
+	var got []int
+	maelstromx.HandleNoReply(node, "notify", func(msg maelstrom.Message, req struct {
+		Values []int `json:"values"`
+	}) error {
+		got = req.Values
+		return nil
+	})
+
+	if replies := run(t, node, `{"type":"notify","values":[1,2]}`); len(replies) != 0 {
+		t.Errorf("got %d replies, want 0", len(replies))
+	}
+	if len(got) != 2 {
+		t.Errorf("handler received %v, want [1 2]", got)
+	}
+}
+
+func TestReply_keepsLargeNumbers(t *testing.T) {
+	node := maelstrom.NewNode()
+	maelstromx.Handle(node, "generate", func(msg maelstrom.Message, req struct{}) (addResponse, error) {
+		return addResponse{Total: 1<<62 + 1}, nil
+	})
+
+	node.Stdin = strings.NewReader(`{"src":"c1","dest":"n0","body":{"type":"generate","msg_id":1}}` + "\n")
+	var out bytes.Buffer
+	node.Stdout = &out
+	if err := node.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"total":4611686018427387905`) {
+		t.Errorf("reply %s lost precision", out.String())
+	}
+}
+
+// run feeds bodies from client c1 to node and returns the decoded reply bodies.
+func run(t *testing.T, node *maelstrom.Node, bodies ...string) []map[string]any {
+	t.Helper()
+
+	var in bytes.Buffer
+	for _, body := range bodies {
+		in.WriteString(`{"src":"c1","dest":"n0","body":` + body + "}\n")
+	}
+
+	var out bytes.Buffer
+	node.Stdin = &in
+	node.Stdout = &out
+	if err := node.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var replies []map[string]any
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var msg maelstrom.Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var body map[string]any
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, body)
+	}
+
+	return replies
+}
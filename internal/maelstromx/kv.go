@@ -0,0 +1,93 @@
+package maelstromx
+
+import (
+	"context"
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// KV is a client of a Maelstrom key/value service with the methods of
+// maelstrom.KV. It sends requests with SyncRPC, so a reply arriving after
+// the deadline doesn't block the node. All errors are *maelstrom.RPCError,
+// with the deadline passing reported as maelstrom.Timeout.
+type KV struct {
+	typ  string
+	node *maelstrom.Node
+}
+
+// NewKV returns a client of the service typ, such as maelstrom.LinKV.
+func NewKV(typ string, node *maelstrom.Node) *KV {
+	return &KV{typ: typ, node: node}
+}
+
+// NewLinKV returns a client of the linearizable key/value store.
+func NewLinKV(node *maelstrom.Node) *KV { return NewKV(maelstrom.LinKV, node) }
+
+// NewSeqKV returns a client of the sequential key/value store.
+func NewSeqKV(node *maelstrom.Node) *KV { return NewKV(maelstrom.SeqKV, node) }
+
+// Read returns the value of key, with numbers as ints. A missing key is
+// reported as maelstrom.KeyDoesNotExist.
+func (kv *KV) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	if err := kv.ReadInto(ctx, key, &value); err != nil {
+		return nil, err
+	}
+
+	if f, ok := value.(float64); ok {
+		return int(f), nil
+	}
+	return value, nil
+}
+
+// ReadInt reads the value of key as an int.
+func (kv *KV) ReadInt(ctx context.Context, key string) (int, error) {
+	v, err := kv.Read(ctx, key)
+	i, _ := v.(int)
+	return i, err
+}
+
+// ReadInto decodes the value of key into v.
+func (kv *KV) ReadInto(ctx context.Context, key string, v any) error {
+	resp, err := kv.call(ctx, map[string]any{"type": "read", "key": key})
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body.Value, v)
+}
+
+// Write sets key to value.
+func (kv *KV) Write(ctx context.Context, key string, value any) error {
+	_, err := kv.call(ctx, map[string]any{"type": "write", "key": key, "value": value})
+	return err
+}
+
+// CompareAndSwap sets key to to if its value is from, creating it if it
+// doesn't exist and createIfNotExists is set. A different value is reported
+// as maelstrom.PreconditionFailed.
+func (kv *KV) CompareAndSwap(ctx context.Context, key string, from, to any, createIfNotExists bool) error {
+	_, err := kv.call(ctx, map[string]any{
+		"type":                 "cas",
+		"key":                  key,
+		"from":                 from,
+		"to":                   to,
+		"create_if_not_exists": createIfNotExists,
+	})
+	return err
+}
+
+func (kv *KV) call(ctx context.Context, body map[string]any) (maelstrom.Message, error) {
+	resp, err := SyncRPC(ctx, kv.node, kv.typ, body)
+	if err != nil && err == ctx.Err() {
+		return resp, maelstrom.NewRPCError(maelstrom.Timeout, err.Error())
+	}
+	return resp, err
+}
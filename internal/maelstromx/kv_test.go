@@ -0,0 +1,66 @@
+package maelstromx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestKV(t *testing.T) {
+	var kv *maelstromx.KV
+	net := maelstromtest.NewNetwork(t)
+	net.AddKV(maelstrom.LinKV)
+	net.AddNodes(1, func(node *maelstrom.Node) { kv = maelstromx.NewLinKV(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := kv.ReadInt(ctx, "a"); maelstrom.ErrorCode(err) != maelstrom.KeyDoesNotExist {
+		t.Errorf("read missing key: got error %v, want KeyDoesNotExist", err)
+	}
+	if err := kv.CompareAndSwap(ctx, "a", 0, 1, false); maelstrom.ErrorCode(err) != maelstrom.KeyDoesNotExist {
+		t.Errorf("cas missing key: got error %v, want KeyDoesNotExist", err)
+	}
+	if err := kv.CompareAndSwap(ctx, "a", 0, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.CompareAndSwap(ctx, "a", 0, 2, false); maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+		t.Errorf("cas from stale value: got error %v, want PreconditionFailed", err)
+	}
+	if got, err := kv.ReadInt(ctx, "a"); err != nil || got != 1 {
+		t.Errorf("read = %d, %v, want 1", got, err)
+	}
+
+	if err := kv.Write(ctx, "b", []string{"x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := kv.ReadInto(ctx, "b", &names); err != nil || len(names) != 2 || names[1] != "y" {
+		t.Errorf("read into = %v, %v, want [x y]", names, err)
+	}
+}
+
+func TestKV_timeout(t *testing.T) {
+	var kv *maelstromx.KV
+	net := maelstromtest.NewNetwork(t)
+	net.AddService(maelstrom.SeqKV, silentService{})
+	net.AddNodes(1, func(node *maelstrom.Node) { kv = maelstromx.NewSeqKV(node) })
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := kv.Write(ctx, "a", 1); maelstrom.ErrorCode(err) != maelstrom.Timeout {
+		t.Errorf("got error %v, want Timeout", err)
+	}
+}
+
+// silentService never answers.
+type silentService struct{}
+
+func (silentService) Handle(msg maelstrom.Message) any { return nil }
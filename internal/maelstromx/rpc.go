@@ -0,0 +1,41 @@
+package maelstromx
+
+import (
+	"context"
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// SyncRPC sends body to dest and waits for the reply, like
+// maelstrom.Node.SyncRPC. Error replies are returned as *maelstrom.RPCError
+// including ones with the zero maelstrom.Timeout code, which
+// maelstrom.Node.SyncRPC returns as a regular reply. A reply arriving after
+// ctx is done is dropped, while maelstrom.Node.SyncRPC blocks its callback
+// forever and with it maelstrom.Node.Run.
+func SyncRPC(ctx context.Context, node *maelstrom.Node, dest string, body any) (maelstrom.Message, error) {
+	respCh := make(chan maelstrom.Message, 1)
+	if err := node.RPC(dest, body, func(msg maelstrom.Message) error {
+		respCh <- msg
+		return nil
+	}); err != nil {
+		return maelstrom.Message{}, err
+	}
+
+	var msg maelstrom.Message
+	select {
+	case <-ctx.Done():
+		return maelstrom.Message{}, ctx.Err()
+	case msg = <-respCh:
+	}
+
+	var reply maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &reply); err != nil {
+		return msg, err
+	}
+	if reply.Type == "error" {
+		return msg, maelstrom.NewRPCError(reply.Code, reply.Text)
+	}
+
+	return msg, nil
+}
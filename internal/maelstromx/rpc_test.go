@@ -0,0 +1,70 @@
+package maelstromx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromx"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestSyncRPC(t *testing.T) {
+	// Nodes are set up in order, before they know their IDs.
+	var nodes []*maelstrom.Node
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, func(node *maelstrom.Node) {
+		maelstromx.Handle(node, "add", func(msg maelstrom.Message, req addRequest) (addResponse, error) {
+			if req.Delta == 99 {
+				return addResponse{}, maelstromx.Errorf(maelstrom.Timeout, "timed out")
+			}
+			return addResponse{Total: int64(req.Delta)}, nil
+		})
+		nodes = append(nodes, node)
+	})
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, tt := range []struct {
+		delta int
+		code  int
+	}{
+		{delta: 1, code: -1},
+		{delta: 99, code: maelstrom.Timeout},
+		{delta: -1, code: maelstrom.MalformedRequest},
+	} {
+		_, err := maelstromx.SyncRPC(ctx, nodes[0], "n1", map[string]any{"type": "add", "delta": tt.delta})
+		if got := maelstrom.ErrorCode(err); got != tt.code {
+			t.Errorf("add %d: got error %v, want code %d", tt.delta, err, tt.code)
+		}
+	}
+}
+
+func TestSyncRPC_lateReply(t *testing.T) {
+	var nodes []*maelstrom.Node
+	setup := func(node *maelstrom.Node) {
+		maelstromx.Handle(node, "add", func(msg maelstrom.Message, req addRequest) (addResponse, error) {
+			time.Sleep(time.Duration(req.Delta) * time.Millisecond)
+			return addResponse{Total: int64(req.Delta)}, nil
+		})
+		nodes = append(nodes, node)
+	}
+	net := maelstromtest.NewNetwork(t)
+	net.AddNodes(2, setup)
+	net.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := maelstromx.SyncRPC(ctx, nodes[0], "n1", map[string]any{"type": "add", "delta": 200}); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The reply arrives once the call gave up. Restart waits for the
+	// handlers of n0, so it hangs if the reply's callback blocks.
+	time.Sleep(300 * time.Millisecond)
+	net.Restart("n0", setup)
+}
@@ -0,0 +1,136 @@
+// Package txntest holds the client scenarios the totally-available
+// transaction solutions are tested with.
+package txntest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpieniak/gossip-glomers/internal/checker"
+	"github.com/bpieniak/gossip-glomers/internal/maelstromtest"
+)
+
+// ReplicatesWrites checks that a write through nodes[0] becomes visible on
+// every other node.
+func ReplicatesWrites(ctx context.Context, t testing.TB, c *maelstromtest.Client, nodes []string) {
+	t.Helper()
+
+	if _, err := c.RPC(ctx, nodes[0], map[string]any{"type": "txn", "txn": [][]any{{"w", 1, 6}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range nodes[1:] {
+		maelstromtest.Eventually(t, time.Second, func() error {
+			var resp struct {
+				Txn json.RawMessage `json:"txn"`
+			}
+			if err := c.RPCInto(ctx, id, map[string]any{"type": "txn", "txn": [][]any{{"r", 1, nil}}}, &resp); err != nil {
+				return err
+			}
+
+			if want := `[["r",1,6]]`; string(resp.Txn) != want {
+				return fmt.Errorf("%s txn = %s, want %s", id, resp.Txn, want)
+			}
+			return nil
+		})
+	}
+}
+
+// ReadsOwnWrites checks that every node answers a transaction reading its
+// own write, even when cut off from the others.
+func ReadsOwnWrites(ctx context.Context, t testing.TB, c *maelstromtest.Client, nodes []string) {
+	t.Helper()
+
+	for _, id := range nodes {
+		var resp struct {
+			Txn json.RawMessage `json:"txn"`
+		}
+		txn := [][]any{{"w", 1, 6}, {"r", 1, nil}}
+		if err := c.RPCInto(ctx, id, map[string]any{"type": "txn", "txn": txn}, &resp); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+
+		if want := `[["w",1,6],["r",1,6]]`; string(resp.Txn) != want {
+			t.Errorf("%s txn = %s, want %s", id, resp.Txn, want)
+		}
+	}
+}
+
+// RandomTxns runs clients concurrent clients, each sending count random
+// transactions over three keys round-robin to nodes, and records them in h.
+// Written values are unique, as checker.CheckTxn requires. Every transaction
+// must succeed, as the nodes are totally available.
+func RandomTxns(ctx context.Context, t testing.TB, h *checker.History, net *maelstromtest.Network, nodes []string, clients, count int) {
+	t.Helper()
+
+	var nextValue atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := net.Client()
+			rng := rand.New(rand.NewSource(int64(i)))
+			for j := range count {
+				node := nodes[(i+j)%len(nodes)]
+
+				mops := make([]checker.Mop, 1+rng.Intn(4))
+				for k := range mops {
+					mops[k] = checker.Mop{F: "r", Key: rng.Intn(3)}
+					if rng.Intn(2) == 0 {
+						value := int(nextValue.Add(1))
+						mops[k] = checker.Mop{F: "w", Key: mops[k].Key, Value: &value}
+					}
+				}
+
+				checker.Record(h, c.ID(), node, "txn", mops, func() ([]checker.Mop, error) {
+					var resp struct {
+						Txn [][3]any `json:"txn"`
+					}
+					err := c.RPCInto(ctx, node, map[string]any{"type": "txn", "txn": encodeMops(mops)}, &resp)
+					return decodeMops(mops, resp.Txn), err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, op := range h.Ops() {
+		if op.Status != checker.OK {
+			t.Fatalf("txn %v on %s did not succeed", op.Value, op.Node)
+		}
+	}
+}
+
+func encodeMops(mops []checker.Mop) [][]any {
+	txn := make([][]any, len(mops))
+	for i, mop := range mops {
+		txn[i] = []any{mop.F, mop.Key, mop.Value}
+	}
+	return txn
+}
+
+// decodeMops applies the values returned in txn to the requested mops.
+func decodeMops(mops []checker.Mop, txn [][3]any) []checker.Mop {
+	out := make([]checker.Mop, len(mops))
+	for i, mop := range mops {
+		out[i] = mop
+		if i >= len(txn) {
+			continue
+		}
+
+		if value, ok := txn[i][2].(float64); ok {
+			v := int(value)
+			out[i].Value = &v
+		}
+	}
+	return out
+}